@@ -0,0 +1,152 @@
+//go:build go1.13
+// +build go1.13
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+)
+
+// Future is the result of a statement sent with SendAsync, which may not
+// have been received yet.
+type Future struct {
+	c     *sql.Conn
+	res   BatchResult
+	ready chan struct{}
+}
+
+// SendAsync sends query to the server over c, and returns without waiting
+// for the result.  Parameters are passed as $1, $2, etc. in query, as with
+// Exec and Query.  The result is read with the Wait method of the Future
+// returned.
+//
+// Several statements can thus be sent before reading any of the results.
+// The server runs them one after the other, each in its own implicit
+// transaction unless a transaction is running on c.  c can be used as usual
+// in the meantime; the results of the statements sent before are then
+// received first, and kept for Wait.  However, SendAsync must not be called
+// while rows returned by a query on c are still open, and should not be used
+// for transaction control statements such as BEGIN, since database/sql does
+// not know about them.  The results which have not been waited for when c is
+// closed are read before the connection is used again.
+//
+// Parameters are sent as SendBatch sends them.  Without binary_parameters, a
+// statement with []byte parameters is thus described first, and SendAsync
+// waits for that.
+//
+// The server may block on sending results if too many of them are waiting
+// to be read, so Wait should be called after a few hundred statements at the
+// most.
+func SendAsync(ctx context.Context, c *sql.Conn, query string, args ...interface{}) (*Future, error) {
+	f := &Future{c: c, ready: make(chan struct{})}
+	err := withConn(ctx, c, func(cn *conn) error {
+		return cn.sendAsync(f, query, args)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Wait waits for the result of the statement, and returns it in the same
+// form as SendBatch does.  An error of the statement itself is reported in
+// the result; the error returned is that of the connection, e.g. because it
+// failed or c was closed before the result was received.  If ctx is done,
+// the statement running on the server is canceled, which may be an earlier
+// one than that of f.
+//
+// Wait may be called several times, and for the statements sent on c in any
+// order.
+func (f *Future) Wait(ctx context.Context) (BatchResult, error) {
+	if f.isReady() {
+		return f.res, nil
+	}
+	err := withConn(ctx, f.c, func(cn *conn) (err error) {
+		if cn.bad {
+			return driver.ErrBadConn
+		}
+		defer cn.errRecover(&err)
+		for !f.isReady() {
+			if len(cn.pending) == 0 {
+				return errors.New("pq: the result of the statement was lost")
+			}
+			cn.readPending(1)
+		}
+		return nil
+	})
+	if err != nil {
+		return BatchResult{}, err
+	}
+	return f.res, nil
+}
+
+func (f *Future) isReady() bool {
+	select {
+	case <-f.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cn *conn) sendAsync(f *Future, query string, args []interface{}) (err error) {
+	if cn.bad {
+		return driver.ErrBadConn
+	}
+	defer cn.errRecover(&err)
+
+	values, err := convertArgs(args)
+	if err != nil {
+		return fmt.Errorf("pq: %v", err)
+	}
+	paramTyps, errs := cn.paramTypes([]string{query}, [][]driver.Value{values})
+	if err := errs[0]; err != nil {
+		if _, ok := err.(*Error); !ok {
+			err = fmt.Errorf("pq: %v", err)
+		}
+		return err
+	}
+	w := cn.writeQuery(nil, query, values, paramTyps[0])
+	w.next('S')
+	cn.send(w)
+
+	cn.pending = append(cn.pending, func() {
+		cn.readResult(&f.res)
+		cn.readReadyForQuery()
+		close(f.ready)
+	})
+	return nil
+}
+
+// Implement the "SessionResetter" interface.  The results of statements sent
+// with SendAsync which were not waited for are read before the connection is
+// handed out again, so that Wait still returns them, and the transaction
+// status is known.
+func (cn *conn) ResetSession(ctx context.Context) error {
+	if cn.bad {
+		return driver.ErrBadConn
+	}
+	if len(cn.pending) == 0 {
+		return nil
+	}
+	finish, err := cn.watchCancel(ctx)
+	if err != nil {
+		return err
+	}
+	err = cn.readAllPending()
+	finish()
+	if err != nil || cn.bad {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func (cn *conn) readAllPending() (err error) {
+	defer cn.errRecover(&err)
+	cn.readPending(len(cn.pending))
+	return nil
+}
@@ -0,0 +1,168 @@
+//go:build go1.13
+// +build go1.13
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestSendAsync(t *testing.T) {
+	queries := make(chan string, 100)
+	connector, err := NewConnector(&Config{
+		User:    "u",
+		SSLMode: "disable",
+		Dialer:  fakeDialer{t: t, handler: batchServer(queries)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	ctx := context.Background()
+	c, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var futures []*Future
+	for _, q := range []string{"INSERT 1", "SELECT $1", "fail", "INSERT 2"} {
+		var args []interface{}
+		if q == "SELECT $1" {
+			args = append(args, 42)
+		}
+		f, err := SendAsync(ctx, c, q, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		futures = append(futures, f)
+	}
+
+	// Waiting for a later result receives the earlier ones.
+	res, err := futures[2].Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := res.Err.(*Error); !ok || err.Code != "23505" {
+		t.Errorf("expected a unique_violation, got %+v", res)
+	}
+	want := BatchResult{
+		Columns:      []string{"?column?"},
+		Rows:         [][]interface{}{{[]byte("42")}},
+		CommandTag:   "SELECT",
+		RowsAffected: 1,
+	}
+	for i := 0; i < 2; i++ {
+		if res, err := futures[1].Wait(ctx); err != nil || !reflect.DeepEqual(res, want) {
+			t.Errorf("got %+v, %v, want %+v", res, err, want)
+		}
+	}
+
+	// So does using the connection otherwise.
+	if _, err := c.ExecContext(ctx, "INSERT 3"); err != nil {
+		t.Fatal(err)
+	}
+	c.Raw(func(driverConn interface{}) error {
+		if n := len(driverConn.(*conn).pending); n != 0 {
+			t.Errorf("expected no pending results, got %d", n)
+		}
+		return nil
+	})
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{3, 0} {
+		res, err := futures[i].Wait(ctx)
+		if err != nil || res.Err != nil || res.CommandTag != "INSERT" || res.RowsAffected != 1 {
+			t.Errorf("unexpected result of the INSERT: %+v, %v", res, err)
+		}
+	}
+
+	close(queries)
+	var got []string
+	for q := range queries {
+		got = append(got, q)
+	}
+	wantQueries := []string{"INSERT 1", "Sync", "SELECT $1", "Sync", "fail", "Sync", "INSERT 2", "Sync", "INSERT 3"}
+	if !reflect.DeepEqual(got, wantQueries) {
+		t.Errorf("got statements %q, want %q", got, wantQueries)
+	}
+}
+
+func TestSendAsyncInTransaction(t *testing.T) {
+	queries := make(chan string, 100)
+	connector, err := NewConnector(&Config{
+		User:    "u",
+		SSLMode: "disable",
+		Dialer:  fakeDialer{t: t, handler: batchServer(queries)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	c, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The failure of a statement whose result has not been read yet must be
+	// noticed when committing.
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := SendAsync(ctx, c, "fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != ErrInFailedTransaction {
+		t.Fatalf("expected ErrInFailedTransaction, got %v", err)
+	}
+	if res, err := f.Wait(ctx); err != nil || res.Err == nil {
+		t.Errorf("expected the statement to fail, got %+v, %v", res, err)
+	}
+	if _, err := c.ExecContext(ctx, "INSERT 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Results which have not been waited for are read before the connection
+	// is used again.
+	f, err = SendAsync(ctx, c, "INSERT 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c, err = db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Raw(func(driverConn interface{}) error {
+		if n := len(driverConn.(*conn).pending); n != 0 {
+			t.Errorf("expected no pending results, got %d", n)
+		}
+		return nil
+	})
+	if res, err := f.Wait(ctx); err != nil || res.Err != nil || res.CommandTag != "INSERT" {
+		t.Errorf("unexpected result of the INSERT: %+v, %v", res, err)
+	}
+
+	close(queries)
+	var got []string
+	for q := range queries {
+		got = append(got, q)
+	}
+	wantQueries := []string{"BEGIN", "fail", "Sync", "ROLLBACK", "INSERT 1", "INSERT 2", "Sync"}
+	if !reflect.DeepEqual(got, wantQueries) {
+		t.Errorf("got statements %q, want %q", got, wantQueries)
+	}
+}
@@ -0,0 +1,402 @@
+package pq
+
+// This file contains the client side of the authentication methods supported
+// by pq, and the Authenticator interface which allows plugging in others.
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq/scram"
+)
+
+// Authentication request codes sent by the server in an AuthenticationRequest
+// message.  See
+// http://www.postgresql.org/docs/current/static/protocol-message-formats.html
+// for the complete list.
+const (
+	AuthOk                = 0
+	AuthCleartextPassword = 3
+	AuthMD5Password       = 5
+	AuthSASL              = 10
+	AuthSASLContinue      = 11
+	AuthSASLFinal         = 12
+)
+
+// Authenticator implements the client side of an authentication method.
+//
+// An Authenticator is registered for an authentication request code with
+// RegisterAuthenticator, or for a SASL mechanism with RegisterSASLMechanism.
+// The same Authenticator is used for all connections, so it must be safe for
+// concurrent use; any state belonging to a single exchange should live in
+// local variables of Authenticate.
+type Authenticator interface {
+	// Authenticate is called when the server sends an AuthenticationRequest
+	// message the Authenticator was registered for.  data is the payload of
+	// that message following the authentication request code; for SASL
+	// mechanisms, it is the list of mechanisms offered by the server.
+	//
+	// Authenticate should carry out the whole exchange using the methods of
+	// a, and return once the client has nothing more to send.  The driver
+	// then waits for the server to accept (AuthenticationOk) or reject
+	// (ErrorResponse) the connection.
+	Authenticate(a *AuthExchange, data []byte) error
+}
+
+// The AuthenticatorFunc type is an adapter to allow the use of ordinary
+// functions as Authenticators.
+type AuthenticatorFunc func(a *AuthExchange, data []byte) error
+
+// Authenticate calls f(a, data).
+func (f AuthenticatorFunc) Authenticate(a *AuthExchange, data []byte) error {
+	return f(a, data)
+}
+
+var authenticators = struct {
+	sync.RWMutex
+	byCode      map[int]Authenticator
+	byMechanism map[string]Authenticator
+}{
+	byCode:      make(map[int]Authenticator),
+	byMechanism: make(map[string]Authenticator),
+}
+
+func init() {
+	RegisterAuthenticator(AuthCleartextPassword, AuthenticatorFunc(authCleartext))
+	RegisterAuthenticator(AuthMD5Password, AuthenticatorFunc(authMD5))
+	RegisterAuthenticator(AuthSASL, AuthenticatorFunc(authSASL))
+	RegisterSASLMechanism("SCRAM-SHA-256", scramAuthenticator{plus: false})
+	RegisterSASLMechanism("SCRAM-SHA-256-PLUS", scramAuthenticator{plus: true})
+}
+
+// RegisterAuthenticator makes a available for authentication requests with
+// the given code, replacing any Authenticator previously registered for that
+// code, including the built-in ones for cleartext passwords, MD5 and SASL.  If
+// a is nil, the registration for code is removed.
+func RegisterAuthenticator(code int, a Authenticator) {
+	if code == AuthOk || code == AuthSASLContinue || code == AuthSASLFinal {
+		panic(fmt.Sprintf("pq: cannot register an Authenticator for authentication request code %d", code))
+	}
+	authenticators.Lock()
+	defer authenticators.Unlock()
+	if a == nil {
+		delete(authenticators.byCode, code)
+	} else {
+		authenticators.byCode[code] = a
+	}
+}
+
+// RegisterSASLMechanism makes a available as the SASL mechanism name,
+// replacing any Authenticator previously registered for that mechanism.  If a
+// is nil, the registration for name is removed.
+//
+// When the server asks for SASL authentication, the first mechanism in the
+// server's list which has been registered is used.  If the connection uses
+// SSL and channel binding has not been disabled, mechanisms whose names end in
+// "-PLUS" are preferred over all others.
+func RegisterSASLMechanism(name string, a Authenticator) {
+	authenticators.Lock()
+	defer authenticators.Unlock()
+	if a == nil {
+		delete(authenticators.byMechanism, name)
+	} else {
+		authenticators.byMechanism[name] = a
+	}
+}
+
+func authenticatorForCode(code int) Authenticator {
+	authenticators.RLock()
+	defer authenticators.RUnlock()
+	return authenticators.byCode[code]
+}
+
+func authenticatorForMechanism(name string) Authenticator {
+	authenticators.RLock()
+	defer authenticators.RUnlock()
+	return authenticators.byMechanism[name]
+}
+
+// AuthExchange gives an Authenticator access to the connection being
+// authenticated.  It is only valid for the duration of the call to
+// Authenticate it was passed to.
+type AuthExchange struct {
+	cn *conn
+	o  values
+
+	// set once the client has verified the server's signature in an exchange
+	// bound to the SSL connection
+	channelBound bool
+}
+
+// Setting returns the value of a connection parameter, e.g. "user",
+// "password" or "host", or the empty string if the parameter is not set.
+func (a *AuthExchange) Setting(key string) string {
+	return a.o.Get(key)
+}
+
+// TLSConnectionState returns the state of the SSL connection to the server.
+// ok is false if the connection does not use SSL.
+func (a *AuthExchange) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	client, ok := a.cn.c.(*tls.Conn)
+	if !ok {
+		return state, false
+	}
+	return client.ConnectionState(), true
+}
+
+// Send sends a PasswordMessage, SASLInitialResponse or SASLResponse message
+// (which all share the message type 'p') to the server.  data is the complete
+// payload of the message.
+func (a *AuthExchange) Send(data []byte) (err error) {
+	defer errRecoverNoErrBadConn(&err)
+
+	w := a.cn.writeBuf('p')
+	w.bytes(data)
+	a.cn.send(w)
+	return nil
+}
+
+// SendSASLInitialResponse sends a SASLInitialResponse message selecting the
+// SASL mechanism name.  data is the mechanism-specific initial response; nil
+// means there is no initial response.
+func (a *AuthExchange) SendSASLInitialResponse(name string, data []byte) (err error) {
+	defer errRecoverNoErrBadConn(&err)
+
+	w := a.cn.writeBuf('p')
+	w.string(name)
+	if data == nil {
+		w.int32(-1)
+	} else {
+		w.int32(len(data))
+		w.bytes(data)
+	}
+	a.cn.send(w)
+	return nil
+}
+
+// Recv receives the next AuthenticationRequest message from the server, and
+// returns its authentication request code and the payload following it.  If
+// the server sends an ErrorResponse instead, it's returned as an *Error.
+func (a *AuthExchange) Recv() (code int, data []byte, err error) {
+	defer errRecoverNoErrBadConn(&err)
+
+	t, r := a.cn.recv()
+	if t != 'R' {
+		errorf("unexpected message %q during authentication", t)
+	}
+	code = r.int32()
+	// r might point into the scratch buffer of the connection
+	data = make([]byte, len(*r))
+	copy(data, *r)
+	return code, data, nil
+}
+
+// auth handles an AuthenticationRequest message received during startup.
+func (cn *conn) auth(r *readBuf, a *AuthExchange) {
+	code := r.int32()
+
+	// With channel_binding=require, we must not let the server get away with
+	// authenticating us by any means other than SCRAM with channel binding;
+	// otherwise a man-in-the-middle could simply ask for the password, or
+	// accept the connection without authentication at all.
+	if a.o.Get("channel_binding") == "require" && !a.channelBound && code != AuthSASL {
+		errorf("channel binding required, but server authenticated client without channel binding")
+	}
+
+	if code == AuthOk {
+		return
+	}
+	auth := authenticatorForCode(code)
+	if auth == nil {
+		errorf("unknown authentication response: %d", code)
+	}
+	data := make([]byte, len(*r))
+	copy(data, *r)
+	if err := auth.Authenticate(a, data); err != nil {
+		panic(err)
+	}
+}
+
+func authCleartext(a *AuthExchange, data []byte) error {
+	return a.Send([]byte(a.Setting("password") + "\000"))
+}
+
+func authMD5(a *AuthExchange, data []byte) error {
+	if len(data) != 4 {
+		return fmt.Errorf("pq: unexpected MD5 salt length %d", len(data))
+	}
+	return a.Send([]byte("md5" + md5s(md5s(a.Setting("password")+a.Setting("user"))+string(data)) + "\000"))
+}
+
+// authSASL picks one of the SASL mechanisms offered by the server in an
+// AuthenticationSASL message and hands the exchange over to the
+// Authenticator registered for it.
+func authSASL(a *AuthExchange, data []byte) error {
+	offered := parseSASLMechanisms(data)
+
+	_, isTLS := a.TLSConnectionState()
+	cbMode := a.Setting("channel_binding")
+	if cbMode == "require" && !isTLS {
+		return errors.New("pq: channel binding required, but SSL is not in use")
+	}
+	wantPlus := isTLS && cbMode != "disable"
+
+	var name string
+	var auth Authenticator
+	for _, m := range offered {
+		if strings.HasSuffix(m, "-PLUS") != wantPlus {
+			continue
+		}
+		if auth = authenticatorForMechanism(m); auth != nil {
+			name = m
+			break
+		}
+	}
+	if auth == nil && wantPlus && cbMode != "require" {
+		// Fall back to a mechanism without channel binding.
+		for _, m := range offered {
+			if strings.HasSuffix(m, "-PLUS") {
+				continue
+			}
+			if auth = authenticatorForMechanism(m); auth != nil {
+				name = m
+				break
+			}
+		}
+	}
+
+	if auth == nil {
+		if cbMode == "require" {
+			return errors.New("pq: channel binding required, but server does not support SCRAM-SHA-256-PLUS")
+		}
+		return fmt.Errorf("pq: none of the SASL authentication mechanisms offered by the server are supported: %s", strings.Join(offered, ", "))
+	}
+	if err := auth.Authenticate(a, data); err != nil {
+		return err
+	}
+	if cbMode == "require" && !a.channelBound {
+		return fmt.Errorf("pq: channel binding required, but SASL mechanism %s does not provide it", name)
+	}
+	return nil
+}
+
+// parseSASLMechanisms parses the payload of an AuthenticationSASL message: a
+// list of mechanism names, terminated by an empty string.
+func parseSASLMechanisms(data []byte) []string {
+	var mechanisms []string
+	for _, m := range strings.Split(string(data), "\000") {
+		if m == "" {
+			break
+		}
+		mechanisms = append(mechanisms, m)
+	}
+	return mechanisms
+}
+
+// scramAuthenticator implements SCRAM-SHA-256, and SCRAM-SHA-256-PLUS with
+// tls-server-end-point channel binding if plus is set.
+type scramAuthenticator struct {
+	plus bool
+}
+
+func (s scramAuthenticator) Authenticate(a *AuthExchange, data []byte) error {
+	mechanism := "SCRAM-SHA-256"
+
+	// The client username in the SCRAM exchange is ignored by the server;
+	// the one from the startup packet is used instead.
+	sc := scram.NewClient(sha256.New, "", a.Setting("password"))
+
+	client, isTLS := a.cn.c.(*tls.Conn)
+	if s.plus {
+		if !isTLS {
+			return errors.New("pq: SCRAM-SHA-256-PLUS requires SSL")
+		}
+		cbData, err := tlsServerEndPoint(client)
+		if err != nil {
+			return err
+		}
+		sc.SetChannelBinding("tls-server-end-point", cbData)
+		mechanism = "SCRAM-SHA-256-PLUS"
+	} else if isTLS && a.Setting("channel_binding") != "disable" {
+		sc.SetChannelBindingSupported()
+	}
+
+	sc.Step(nil)
+	if sc.Err() != nil {
+		return fmt.Errorf("pq: %s error: %s", mechanism, sc.Err())
+	}
+	if err := a.SendSASLInitialResponse(mechanism, sc.Out()); err != nil {
+		return err
+	}
+
+	code, data, err := a.Recv()
+	if err != nil {
+		return err
+	}
+	if code != AuthSASLContinue {
+		return fmt.Errorf("pq: unexpected authentication response: %d", code)
+	}
+	sc.Step(data)
+	if sc.Err() != nil {
+		return fmt.Errorf("pq: %s error: %s", mechanism, sc.Err())
+	}
+	if err := a.Send(sc.Out()); err != nil {
+		return err
+	}
+
+	code, data, err = a.Recv()
+	if err != nil {
+		return err
+	}
+	if code != AuthSASLFinal {
+		return fmt.Errorf("pq: unexpected authentication response: %d", code)
+	}
+	// The server signature must be verified before we accept the
+	// AuthenticationOk which follows; otherwise a server which does not know
+	// the password could pretend the exchange was successful.
+	if sc.Step(data) {
+		return fmt.Errorf("pq: %s error: unexpected end of exchange", mechanism)
+	}
+	if sc.Err() != nil {
+		return fmt.Errorf("pq: %s error: %s", mechanism, sc.Err())
+	}
+	a.channelBound = s.plus
+	return nil
+}
+
+// tlsServerEndPoint returns the "tls-server-end-point" channel binding data
+// for client as defined in RFC 5929: a hash of the server's certificate, using
+// the hash function from the certificate's signature algorithm, or SHA-256 if
+// that is MD5 or SHA-1.
+func tlsServerEndPoint(client *tls.Conn) ([]byte, error) {
+	if err := client.Handshake(); err != nil {
+		return nil, err
+	}
+	certs := client.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("pq: server did not present a certificate for channel binding")
+	}
+	cert := certs[0]
+
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1,
+		x509.SHA256WithRSA, x509.DSAWithSHA256, x509.ECDSAWithSHA256, x509.SHA256WithRSAPSS:
+		h = sha256.New()
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("pq: could not determine channel binding hash for server certificate signature algorithm %v", cert.SignatureAlgorithm)
+	}
+	h.Write(cert.Raw)
+	return h.Sum(nil), nil
+}
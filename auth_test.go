@@ -0,0 +1,435 @@
+package pq
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scramServer describes how a fakeBackend should behave in a SCRAM exchange.
+type scramServer struct {
+	// SASL mechanisms to offer; SCRAM-SHA-256 if empty
+	mechanisms []string
+	// the password the client must know for the exchange to succeed
+	password string
+	// If set, the backend pretends the client's proof was correct but sends
+	// a server signature computed without knowing the password.
+	forgeSignature bool
+}
+
+// serveSCRAM runs the server side of a SCRAM-SHA-256 or SCRAM-SHA-256-PLUS
+// exchange, and returns the GS2 header sent by the client.
+func (b *fakeBackend) serveSCRAM(srv scramServer) string {
+	if len(srv.mechanisms) == 0 {
+		srv.mechanisms = []string{"SCRAM-SHA-256"}
+	}
+	b.sendAuth(10, []byte(strings.Join(srv.mechanisms, "\x00")+"\x00\x00"))
+
+	r := b.expect('p')
+	mechanism := r.string()
+	clientFirst := string(r.next(r.int32()))
+	i := strings.Index(clientFirst, ",,")
+	gs2Header := clientFirst[:i+2]
+	clientFirstBare := clientFirst[i+2:]
+	clientNonce := clientFirstBare[strings.Index(clientFirstBare, ",r=")+3:]
+
+	// Check the channel binding the same way the server does.
+	cbind := []byte(gs2Header)
+	switch {
+	case mechanism == "SCRAM-SHA-256-PLUS" && gs2Header == "p=tls-server-end-point,,":
+		sum := sha256.Sum256(b.tlsConfig.Certificates[0].Certificate[0])
+		cbind = append(cbind, sum[:]...)
+	case mechanism == "SCRAM-SHA-256" && gs2Header == "n,,":
+	case mechanism == "SCRAM-SHA-256" && gs2Header == "y,,":
+		for _, m := range srv.mechanisms {
+			if m == "SCRAM-SHA-256-PLUS" {
+				b.sendError("FATAL", "08P01", "SCRAM channel binding negotiation error")
+				return gs2Header
+			}
+		}
+	default:
+		panic(fmt.Sprintf("unexpected GS2 header %q for mechanism %q", gs2Header, mechanism))
+	}
+
+	salt := []byte("pq fake backend salt")
+	serverFirst := fmt.Sprintf("r=%sfakebackendnonce,s=%s,i=4096", clientNonce, base64.StdEncoding.EncodeToString(salt))
+	b.sendAuth(11, []byte(serverFirst))
+
+	clientFinal := string(*b.expect('p'))
+	if want := "c=" + base64.StdEncoding.EncodeToString(cbind) + ","; !strings.HasPrefix(clientFinal, want) {
+		b.sendError("FATAL", "08P01", "SCRAM channel binding check failed")
+		return gs2Header
+	}
+	i = strings.Index(clientFinal, ",p=")
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+	if err != nil {
+		panic(err)
+	}
+	authMsg := clientFirstBare + "," + serverFirst + "," + clientFinal[:i]
+
+	mac := func(key []byte, s string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(s))
+		return h.Sum(nil)
+	}
+	// Hi() with a single block
+	u := mac([]byte(srv.password), string(salt)+"\x00\x00\x00\x01")
+	salted := append([]byte(nil), u...)
+	for n := 1; n < 4096; n++ {
+		u = mac([]byte(srv.password), string(u))
+		for j := range salted {
+			salted[j] ^= u[j]
+		}
+	}
+
+	storedKey := sha256.Sum256(mac(salted, "Client Key"))
+	clientSignature := mac(storedKey[:], authMsg)
+	for j := range proof {
+		proof[j] ^= clientSignature[j]
+	}
+	if sha256.Sum256(proof) != storedKey && !srv.forgeSignature {
+		b.sendError("FATAL", "28P01", "password authentication failed")
+		return gs2Header
+	}
+
+	serverKey := mac(salted, "Server Key")
+	if srv.forgeSignature {
+		serverKey = mac([]byte("not the password"), "Server Key")
+	}
+	serverSignature := mac(serverKey, authMsg)
+	b.sendAuth(12, []byte("v="+base64.StdEncoding.EncodeToString(serverSignature)))
+	b.sendAuth(0, nil)
+	b.sendReady()
+	return gs2Header
+}
+
+func TestAuthSCRAM(t *testing.T) {
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		params := b.startup()
+		if params["user"] != "pqgoscram" {
+			panic(fmt.Sprintf("unexpected user %q", params["user"]))
+		}
+		b.serveSCRAM(scramServer{password: "correct horse"})
+	}}
+
+	cn, err := DialOpen(d, "user=pqgoscram password='correct horse' sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.Close()
+
+	_, err = DialOpen(d, "user=pqgoscram password=wrong sslmode=disable")
+	if pgErr, ok := err.(*Error); !ok || pgErr.Code != "28P01" {
+		t.Fatalf("expected invalid_password error, got %#v", err)
+	}
+}
+
+func TestAuthSCRAMBadServerSignature(t *testing.T) {
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		b.startup()
+		b.serveSCRAM(scramServer{password: "whatever", forgeSignature: true})
+	}}
+
+	_, err := DialOpen(d, "user=pqgoscram password=secret sslmode=disable")
+	if err == nil || !strings.Contains(err.Error(), "server signature") {
+		t.Fatalf("expected server signature verification to fail, got %v", err)
+	}
+}
+
+func TestAuthSASLUnsupportedMechanism(t *testing.T) {
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		b.startup()
+		b.sendAuth(10, []byte("SCRAM-SHA-512\x00\x00"))
+	}}
+
+	_, err := DialOpen(d, "user=pqgoscram password=secret sslmode=disable")
+	if err == nil || !strings.Contains(err.Error(), "SASL") {
+		t.Fatalf("expected an unsupported SASL mechanism error, got %v", err)
+	}
+}
+
+func TestAuthSCRAMChannelBinding(t *testing.T) {
+	tests := []struct {
+		mechanisms []string
+		conninfo   string
+		gs2Header  string
+		err        string
+	}{
+		// SSL not in use; channel binding is not possible
+		{
+			mechanisms: []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"},
+			conninfo:   "sslmode=disable",
+			gs2Header:  "n,,",
+		},
+		{
+			mechanisms: []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"},
+			conninfo:   "sslmode=disable channel_binding=require",
+			err:        "SSL is not in use",
+		},
+		// SSL in use, and the server supports channel binding
+		{
+			mechanisms: []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"},
+			conninfo:   "sslmode=require",
+			gs2Header:  "p=tls-server-end-point,,",
+		},
+		{
+			mechanisms: []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"},
+			conninfo:   "sslmode=require channel_binding=require",
+			gs2Header:  "p=tls-server-end-point,,",
+		},
+		{
+			mechanisms: []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"},
+			conninfo:   "sslmode=require channel_binding=disable",
+			gs2Header:  "n,,",
+		},
+		// SSL in use, but the server does not support channel binding (or
+		// someone stripped SCRAM-SHA-256-PLUS from the list)
+		{
+			mechanisms: []string{"SCRAM-SHA-256"},
+			conninfo:   "sslmode=require",
+			gs2Header:  "y,,",
+		},
+		{
+			mechanisms: []string{"SCRAM-SHA-256"},
+			conninfo:   "sslmode=require channel_binding=require",
+			err:        "server does not support SCRAM-SHA-256-PLUS",
+		},
+	}
+
+	for _, tt := range tests {
+		gs2Header := make(chan string, 1)
+		d := fakeDialer{t: t, tlsConfig: fakeTLSConfig(t), handler: func(b *fakeBackend) {
+			b.startup()
+			gs2Header <- b.serveSCRAM(scramServer{mechanisms: tt.mechanisms, password: "secret"})
+		}}
+
+		cn, err := DialOpen(d, "user=pqgoscram password=secret "+tt.conninfo)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error containing %q, got %v", tt.conninfo, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.conninfo, err)
+			continue
+		}
+		cn.Close()
+		if got := <-gs2Header; got != tt.gs2Header {
+			t.Errorf("%s: expected GS2 header %q, got %q", tt.conninfo, tt.gs2Header, got)
+		}
+	}
+}
+
+func TestAuthChannelBindingRequiredWithoutSCRAM(t *testing.T) {
+	tests := []struct {
+		auth func(b *fakeBackend)
+	}{
+		// trust
+		{func(b *fakeBackend) {}},
+		// password
+		{func(b *fakeBackend) { b.sendAuth(3, nil) }},
+		// md5
+		{func(b *fakeBackend) { b.sendAuth(5, []byte("salt")) }},
+	}
+
+	for i, tt := range tests {
+		d := fakeDialer{t: t, tlsConfig: fakeTLSConfig(t), handler: func(b *fakeBackend) {
+			b.startup()
+			tt.auth(b)
+			b.sendAuth(0, nil)
+			b.sendReady()
+		}}
+
+		_, err := DialOpen(d, "user=pqgoscram password=secret sslmode=require channel_binding=require")
+		if err == nil || !strings.Contains(err.Error(), "without channel binding") {
+			t.Errorf("%d: expected channel binding error, got %v", i, err)
+		}
+	}
+}
+
+func TestInvalidChannelBinding(t *testing.T) {
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {}}
+	_, err := DialOpen(d, "user=pqgoscram sslmode=disable channel_binding=maybe")
+	if err == nil || !strings.Contains(err.Error(), "unsupported channel_binding") {
+		t.Fatalf("expected an error, got %v", err)
+	}
+}
+
+func TestAuthPassword(t *testing.T) {
+	tests := []struct {
+		code     int
+		salt     string
+		password string
+	}{
+		{AuthCleartextPassword, "", "secret"},
+		// md5(md5("secret" + "pqgotest") + "salt")
+		{AuthMD5Password, "salt", "md5" + md5s(md5s("secretpqgotest")+"salt")},
+	}
+
+	for _, tt := range tests {
+		d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+			b.startup()
+			b.sendAuth(tt.code, []byte(tt.salt))
+			if password := b.expect('p').string(); password != tt.password {
+				b.sendError("FATAL", "28P01", "password authentication failed")
+				return
+			}
+			b.sendAuth(AuthOk, nil)
+			b.sendReady()
+		}}
+
+		cn, err := DialOpen(d, "user=pqgotest password=secret sslmode=disable")
+		if err != nil {
+			t.Errorf("%d: %v", tt.code, err)
+			continue
+		}
+		cn.Close()
+	}
+}
+
+func TestAuthUnknownCode(t *testing.T) {
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		b.startup()
+		b.sendAuth(42, nil)
+	}}
+
+	_, err := DialOpen(d, "user=pqgotest sslmode=disable")
+	if err == nil || err.Error() != "pq: unknown authentication response: 42" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestRegisterAuthenticator(t *testing.T) {
+	const authToken = 42
+	RegisterAuthenticator(authToken, AuthenticatorFunc(func(a *AuthExchange, data []byte) error {
+		if string(data) != "realm" {
+			return fmt.Errorf("unexpected data %q", data)
+		}
+		return a.Send([]byte("token-for-" + a.Setting("user")))
+	}))
+	defer RegisterAuthenticator(authToken, nil)
+
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		b.startup()
+		b.sendAuth(authToken, []byte("realm"))
+		if token := string(*b.expect('p')); token != "token-for-pqgotest" {
+			b.sendError("FATAL", "28000", "invalid token "+token)
+			return
+		}
+		b.sendAuth(AuthOk, nil)
+		b.sendReady()
+	}}
+
+	cn, err := DialOpen(d, "user=pqgotest sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.Close()
+}
+
+func TestRegisterSASLMechanism(t *testing.T) {
+	RegisterSASLMechanism("OAUTHBEARER", AuthenticatorFunc(func(a *AuthExchange, data []byte) error {
+		// The final AuthenticationOk or error is handled by the caller.
+		return a.SendSASLInitialResponse("OAUTHBEARER", []byte("n,,\x01auth=Bearer "+a.Setting("password")+"\x01\x01"))
+	}))
+	defer RegisterSASLMechanism("OAUTHBEARER", nil)
+
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		b.startup()
+		b.sendAuth(AuthSASL, []byte("SCRAM-SHA-256\x00OAUTHBEARER\x00\x00"))
+		r := b.expect('p')
+		if r.string() != "SCRAM-SHA-256" {
+			panic("expected SCRAM-SHA-256 to be preferred, as listed first by the server")
+		}
+		b.sendError("FATAL", "28000", "no SCRAM")
+	}}
+	_, err := DialOpen(d, "user=pqgotest sslmode=disable")
+	if pgErr, ok := err.(*Error); !ok || pgErr.Message != "no SCRAM" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	d.handler = func(b *fakeBackend) {
+		b.startup()
+		b.sendAuth(AuthSASL, []byte("OAUTHBEARER\x00\x00"))
+		r := b.expect('p')
+		if mechanism := r.string(); mechanism != "OAUTHBEARER" {
+			panic("unexpected mechanism " + mechanism)
+		}
+		if data := string(r.next(r.int32())); data == "n,,\x01auth=Bearer good-token\x01\x01" {
+			b.sendAuth(AuthOk, nil)
+			b.sendReady()
+			return
+		}
+		b.sendError("FATAL", "28000", "OAuth bearer authentication failed")
+	}
+	cn, err := DialOpen(d, "user=pqgotest password=good-token sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.Close()
+
+	_, err = DialOpen(d, "user=pqgotest password=bad-token sslmode=disable")
+	if pgErr, ok := err.(*Error); !ok || pgErr.Code != "28000" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestPasswordFunc(t *testing.T) {
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		b.startup()
+		b.sendAuth(AuthCleartextPassword, nil)
+		if password := b.expect('p').string(); password != "token-2" {
+			b.sendError("FATAL", "28P01", "password authentication failed")
+			return
+		}
+		b.sendAuth(AuthOk, nil)
+		b.sendReady()
+	}, delay: 100 * time.Millisecond}
+
+	var calls int
+	var start time.Time
+	passwordFunc := func(ctx context.Context, host, port, user, dbname string) (string, error) {
+		if host != "db.example.com" || port != "6543" || user != "pqgotest" || dbname != "pqgotest" {
+			t.Errorf("unexpected arguments %q %q %q %q", host, port, user, dbname)
+		}
+		// The connect_timeout covers dialing as well.
+		if deadline, ok := ctx.Deadline(); !ok || deadline.After(start.Add(5*time.Second+d.delay/2)) {
+			t.Errorf("expected connect_timeout to set a deadline from the start of the attempt, got %v", deadline)
+		}
+		calls++
+		if calls == 3 {
+			return "", errors.New("token service unavailable")
+		}
+		return fmt.Sprintf("token-%d", calls), nil
+	}
+
+	const dsn = "host=db.example.com port=6543 user=pqgotest dbname=pqgotest password=stale sslmode=disable connect_timeout=5"
+	start = time.Now()
+	_, err := dialOpen(d, dsn, &Driver{PasswordFunc: passwordFunc})
+	if pgErr, ok := err.(*Error); !ok || pgErr.Code != "28P01" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	start = time.Now()
+	cn, err := dialOpen(d, dsn, &Driver{PasswordFunc: passwordFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.Close()
+	// The connection is closed before the startup packet is sent.
+	d.handler = func(b *fakeBackend) {}
+	start = time.Now()
+	_, err = dialOpen(d, dsn, &Driver{PasswordFunc: passwordFunc})
+	if err == nil || err.Error() != "token service unavailable" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls to PasswordFunc, got %d", calls)
+	}
+}
@@ -0,0 +1,341 @@
+//go:build go1.13
+// +build go1.13
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq/oid"
+)
+
+// ErrBatchSkipped is the error of the statements of a batch which the server
+// did not run, because an earlier statement of the batch failed.
+var ErrBatchSkipped = errors.New("pq: statement skipped because an earlier statement of the batch failed")
+
+// Batch is a list of statements which SendBatch sends to the server all at
+// once, rather than waiting for the result of each statement before sending
+// the next one.
+//
+// By default the statements are followed by a single Sync message, so that
+// if one of them fails, the server skips the rest of the batch; outside of a
+// transaction, the batch is then run as a single implicit transaction, which
+// is rolled back on failure.  If SyncEach is set, each statement is followed
+// by its own Sync, and runs regardless of whether the earlier statements
+// failed; outside of a transaction, each statement then commits on its own.
+type Batch struct {
+	SyncEach bool
+
+	items []batchItem
+}
+
+type batchItem struct {
+	query string
+	args  []interface{}
+}
+
+// Queue adds a statement to the batch.  Parameters are passed as $1, $2, etc.
+// in query, as with Exec and Query.
+func (b *Batch) Queue(query string, args ...interface{}) {
+	b.items = append(b.items, batchItem{query: query, args: args})
+}
+
+// Len returns the number of statements in the batch.
+func (b *Batch) Len() int {
+	return len(b.items)
+}
+
+// BatchResult is the result of a statement of a Batch.
+type BatchResult struct {
+	// The columns and rows returned by the statement, if any.  Values have
+	// the same types as those returned by rows.Next of the driver.
+	Columns []string
+	Rows    [][]interface{}
+
+	// The command tag of the statement, e.g. "INSERT", and the number of
+	// rows it affected.
+	CommandTag   string
+	RowsAffected int64
+
+	// If set, the statement failed, and the other fields are empty.
+	Err error
+}
+
+// SendBatch sends the statements of b to the server over c, without waiting
+// for the result of each statement before sending the next one, and returns
+// their results in order.  Errors of individual statements are reported in
+// their results; the error returned is that of the batch as a whole, e.g.
+// because the connection failed.
+//
+// Parameters are sent untyped, for the server to infer their types, except
+// that without binary_parameters, []byte parameters are sent like Exec sends
+// them, which depends on their type.  The statements with []byte parameters
+// are therefore described first, in another round trip.  If one of them
+// can't be prepared, e.g. because of a syntax error, that is the error of the
+// statement if SyncEach is set, and it is not run; otherwise SendBatch
+// returns the error, and runs none of the statements.
+//
+// The results are read while the statements are still being sent, so batches
+// may be of any size.
+func SendBatch(ctx context.Context, c *sql.Conn, b *Batch) ([]BatchResult, error) {
+	if len(b.items) == 0 {
+		return nil, nil
+	}
+	var results []BatchResult
+	err := withConn(ctx, c, func(cn *conn) (err error) {
+		results, err = cn.sendBatch(b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (cn *conn) sendBatch(b *Batch) (results []BatchResult, err error) {
+	if cn.bad {
+		return nil, driver.ErrBadConn
+	}
+	defer cn.errRecover(&err)
+
+	queries := make([]string, len(b.items))
+	args := make([][]driver.Value, len(b.items))
+	for i, item := range b.items {
+		queries[i] = item.query
+		args[i], err = convertArgs(item.args)
+		if err != nil {
+			return nil, fmt.Errorf("pq: statement %d of the batch: %v", i, err)
+		}
+	}
+	paramTyps, errs := cn.paramTypes(queries, args)
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(*Error); !ok {
+			err = fmt.Errorf("pq: statement %d of the batch: %v", i, err)
+			errs[i] = err
+		}
+		if !b.SyncEach {
+			return nil, err
+		}
+	}
+
+	results = make([]BatchResult, len(b.items))
+	var w *writeBuf
+	for i, query := range queries {
+		if errs[i] != nil {
+			results[i].Err = errs[i]
+			continue
+		}
+		w = cn.writeQuery(w, query, args[i], paramTyps[i])
+		if b.SyncEach || i == len(queries)-1 {
+			w.next('S')
+		}
+	}
+	if w == nil {
+		return results, nil
+	}
+
+	cn.sendWhileReading(w, func() {
+		skipped := false
+		for i := range results {
+			if errs[i] != nil {
+				continue
+			}
+			if skipped {
+				results[i].Err = ErrBatchSkipped
+				continue
+			}
+			cn.readResult(&results[i])
+			if b.SyncEach {
+				cn.readReadyForQuery()
+			} else if results[i].Err != nil {
+				// The server skips the rest of the batch.
+				skipped = true
+			}
+		}
+		if !b.SyncEach {
+			cn.readReadyForQuery()
+		}
+	})
+	return results, nil
+}
+
+// convertArgs converts the parameters of a statement to driver values, the
+// way database/sql does.
+func convertArgs(args []interface{}) ([]driver.Value, error) {
+	if len(args) >= 65536 {
+		return nil, fmt.Errorf("got %d parameters but PostgreSQL only supports 65535 parameters", len(args))
+	}
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		v, err := driver.DefaultParameterConverter.ConvertValue(arg)
+		if err != nil {
+			return nil, fmt.Errorf("converting argument $%d: %v", i+1, err)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// paramTypes returns the parameter types of those of queries, to be run with
+// args, whose parameters writeQuery can't encode without knowing their types:
+// without binary_parameters, those with []byte parameters.  These queries
+// are described together, in a single round trip, but each with its own Sync,
+// so that an error of one doesn't affect the others.  If a query can't be
+// prepared, or has the wrong number of parameters, its error is returned in
+// errs.  The types of the other queries are nil.
+func (cn *conn) paramTypes(queries []string, args [][]driver.Value) (paramTyps [][]oid.Oid, errs []error) {
+	paramTyps = make([][]oid.Oid, len(queries))
+	errs = make([]error, len(queries))
+	if cn.binaryParameters {
+		return paramTyps, errs
+	}
+	var described []int
+	var w *writeBuf
+	for i, query := range queries {
+		if !hasBytes(args[i]) {
+			continue
+		}
+		described = append(described, i)
+		if w == nil {
+			w = cn.writeBuf('P')
+		} else {
+			w.next('P')
+		}
+		w.byte(0) // unnamed statement
+		w.string(query)
+		w.int16(0)
+
+		w.next('D')
+		w.byte('S')
+		w.byte(0) // unnamed statement
+
+		w.next('S')
+	}
+	if w == nil {
+		return paramTyps, errs
+	}
+	cn.sendWhileReading(w, func() {
+		for _, i := range described {
+			paramTyps[i], errs[i] = cn.readParamTypes()
+		}
+	})
+	for _, i := range described {
+		if errs[i] == nil && len(args[i]) != len(paramTyps[i]) {
+			errs[i] = fmt.Errorf("got %d parameters but the statement requires %d", len(args[i]), len(paramTyps[i]))
+		}
+	}
+	return paramTyps, errs
+}
+
+// hasBytes reports whether any of args is a []byte.
+func hasBytes(args []driver.Value) bool {
+	for _, arg := range args {
+		if _, ok := arg.([]byte); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readParamTypes reads the response to the Parse, Describe and Sync messages
+// written by paramTypes for a query.  The error of the query, if the server
+// reports one, is returned rather than raised.
+func (cn *conn) readParamTypes() (paramTyps []oid.Oid, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			pqErr, ok := p.(*Error)
+			if !ok || cn.bad {
+				panic(p)
+			}
+			paramTyps, err = nil, pqErr
+		}
+	}()
+	cn.readParseResponse()
+	paramTyps, _, _ = cn.readStatementDescribeResponse()
+	cn.readReadyForQuery()
+	return paramTyps, nil
+}
+
+// sendWhileReading sends w while read reads the responses to it, so that
+// neither the server nor we block on sending while the other isn't reading.
+// It returns once both are done.
+func (cn *conn) sendWhileReading(w *writeBuf, read func()) {
+	sent := make(chan error, 1)
+	go func() {
+		_, err := cn.c.Write(w.wrap())
+		sent <- err
+	}()
+	defer func() {
+		if p := recover(); p != nil {
+			// Unless the server reported an error of the statement, the
+			// connection is of no more use, and closing it makes sure the
+			// sending ends.
+			if _, ok := p.(*Error); !ok || cn.bad {
+				cn.bad = true
+				cn.c.Close()
+			}
+			<-sent
+			panic(p)
+		}
+		if err := <-sent; err != nil {
+			panic(err)
+		}
+	}()
+	read()
+}
+
+// readResult reads the response to the messages written by writeQuery into
+// res.  It returns after the CommandComplete or ErrorResponse message, so the
+// ReadyForQuery message, if any, is left to the caller.
+func (cn *conn) readResult(res *BatchResult) {
+	var colTyps []oid.Oid
+	var colFmts []format
+	for {
+		t, r := cn.recv1()
+		switch t {
+		case '1', '2', 'n':
+		case 'T':
+			res.Columns, colFmts, colTyps = parsePortalRowDescribe(r)
+		case 'D':
+			n := r.int16()
+			if n != len(colTyps) {
+				cn.bad = true
+				errorf("unexpected DataRow with %d columns, expected %d", n, len(colTyps))
+			}
+			row := make([]interface{}, n)
+			for i := range row {
+				l := r.int32()
+				if l == -1 {
+					continue
+				}
+				v := decode(&cn.parameterStatus, r.next(l), colTyps[i], colFmts[i])
+				if buf, ok := v.([]byte); ok {
+					// decode may return a slice of the receive buffer.
+					v = append([]byte(nil), buf...)
+				}
+				row[i] = v
+			}
+			res.Rows = append(res.Rows, row)
+		case 'C':
+			result, tag := cn.parseComplete(r.string())
+			res.CommandTag = tag
+			res.RowsAffected, _ = result.RowsAffected()
+			return
+		case 'I':
+			return
+		case 'E':
+			*res = BatchResult{Err: parseError(r)}
+			return
+		default:
+			cn.bad = true
+			errorf("unexpected message %q in response to an extended query", t)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+//go:build go1.13
+// +build go1.13
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq/oid"
+)
+
+// batchServer returns a fake server for the extended query protocol.  Queries
+// starting with "SELECT" return their first parameter, prefixed by "binary "
+// if it was sent in binary, "fail" fails, and any other query succeeds as an
+// INSERT, as do simple queries other than BEGIN, COMMIT and ROLLBACK, which
+// keep track of the transaction status.  Queries starting with "bad" fail to
+// parse.
+// Parameters are of type text, or bytea if the query mentions bytea.  After
+// an error, messages are skipped until the next Sync, like a real server
+// does.  The queries executed and the Syncs received are sent to queries.
+func batchServer(queries chan<- string) func(b *fakeBackend) {
+	return func(b *fakeBackend) {
+		b.startup()
+		b.sendAuth(AuthOk, nil)
+		b.sendParameterStatus("server_version", "14.0")
+		b.sendReady()
+		var query, param string
+		failed := false
+		b.serveQueries(queries, func(q string) string {
+			switch {
+			case q == "BEGIN":
+				b.txnStatus = 'T'
+				return q
+			case q == "COMMIT" && b.txnStatus == 'E', q == "ROLLBACK":
+				b.txnStatus = 'I'
+				return "ROLLBACK"
+			case q == "COMMIT":
+				b.txnStatus = 'I'
+				return q
+			}
+			return "INSERT 0 1"
+		}, func(t byte, r *readBuf) {
+			if t == 'S' {
+				queries <- "Sync"
+				failed = false
+				b.sendReady()
+				return
+			} else if failed {
+				return
+			}
+			switch t {
+			case 'P':
+				r.string()
+				query = r.string()
+				if strings.HasPrefix(query, "bad") {
+					b.sendError("ERROR", "42601", "syntax error")
+					failed = true
+					return
+				}
+				b.send('1', nil)
+			case 'B':
+				r.string()
+				r.string()
+				formats := make([]int, r.int16())
+				for i := range formats {
+					formats[i] = r.int16()
+				}
+				param = ""
+				if r.int16() > 0 {
+					if l := r.int32(); l >= 0 {
+						param = string(r.next(l))
+						if len(formats) > 0 && formats[0] == 1 {
+							param = "binary " + param
+						}
+					}
+				}
+				b.send('2', nil)
+			case 'D':
+				if r.byte() == 'S' {
+					typ := oid.T_text
+					if strings.Contains(query, "bytea") {
+						typ = oid.T_bytea
+					}
+					n := strings.Count(query, "$")
+					w := &writeBuf{}
+					w.int16(n)
+					for i := 0; i < n; i++ {
+						w.int32(int(typ))
+					}
+					b.send('t', w.buf)
+				}
+				if strings.HasPrefix(query, "SELECT") {
+					b.sendRowDescription(oid.T_text)
+				} else {
+					b.send('n', nil)
+				}
+			case 'E':
+				queries <- query
+				switch {
+				case strings.HasPrefix(query, "SELECT"):
+					b.sendDataRow(param)
+					b.sendCommandComplete("SELECT 1")
+				case query == "fail":
+					b.sendError("ERROR", "23505", "failed")
+					failed = true
+					if b.txnStatus == 'T' {
+						b.txnStatus = 'E'
+					}
+				default:
+					b.sendCommandComplete("INSERT 0 1")
+				}
+			default:
+				panic(fmt.Sprintf("unexpected message %q", t))
+			}
+		})
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	queries := make(chan string, 100)
+	connector, err := NewConnector(&Config{
+		User:    "u",
+		SSLMode: "disable",
+		Dialer:  fakeDialer{t: t, handler: batchServer(queries)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	ctx := context.Background()
+	c, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	received := func() []string {
+		var got []string
+		for len(queries) > 0 {
+			got = append(got, <-queries)
+		}
+		return got
+	}
+
+	for _, syncEach := range []bool{false, true} {
+		b := &Batch{SyncEach: syncEach}
+		b.Queue("INSERT 1")
+		b.Queue("SELECT $1", 42)
+		b.Queue("fail")
+		b.Queue("SELECT $1", []byte("bytes"))
+		if b.Len() != 4 {
+			t.Fatalf("expected 4 statements, got %d", b.Len())
+		}
+		results, err := SendBatch(ctx, c, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 4 {
+			t.Fatalf("expected 4 results, got %d", len(results))
+		}
+		if r := results[0]; r.Err != nil || r.CommandTag != "INSERT" || r.RowsAffected != 1 {
+			t.Errorf("unexpected result of the INSERT: %+v", r)
+		}
+		want := BatchResult{
+			Columns:      []string{"?column?"},
+			Rows:         [][]interface{}{{[]byte("42")}},
+			CommandTag:   "SELECT",
+			RowsAffected: 1,
+		}
+		if !reflect.DeepEqual(results[1], want) {
+			t.Errorf("got %+v, want %+v", results[1], want)
+		}
+		if err, ok := results[2].Err.(*Error); !ok || err.Code != "23505" {
+			t.Errorf("expected a unique_violation, got %v", results[2].Err)
+		}
+
+		var wantQueries []string
+		if syncEach {
+			want.Rows = [][]interface{}{{[]byte("bytes")}}
+			if !reflect.DeepEqual(results[3], want) {
+				t.Errorf("got %+v, want %+v", results[3], want)
+			}
+			wantQueries = []string{"Sync", "INSERT 1", "Sync", "SELECT $1", "Sync", "fail", "Sync", "SELECT $1", "Sync"}
+		} else {
+			if results[3].Err != ErrBatchSkipped {
+				t.Errorf("expected %v, got %+v", ErrBatchSkipped, results[3])
+			}
+			wantQueries = []string{"Sync", "INSERT 1", "SELECT $1", "fail", "Sync"}
+		}
+		if got := received(); !reflect.DeepEqual(got, wantQueries) {
+			t.Errorf("got statements %q, want %q", got, wantQueries)
+		}
+	}
+
+	// Conversion errors fail the whole batch before anything is sent.
+	b := &Batch{}
+	b.Queue("INSERT 1")
+	b.Queue("INSERT 2", struct{}{})
+	if _, err := SendBatch(ctx, c, b); err == nil || !strings.Contains(err.Error(), "statement 1") {
+		t.Fatalf("expected a conversion error, got %v", err)
+	}
+	if got := received(); got != nil {
+		t.Errorf("expected no statements, got %q", got)
+	}
+
+	// So do statements which can't be prepared to learn their parameter
+	// types, or have the wrong number of parameters, unless SyncEach is set,
+	// in which case only those statements fail.
+	for _, bad := range []string{"bad $1", "INSERT $1"} {
+		b = &Batch{}
+		b.Queue("INSERT 1")
+		b.Queue(bad, []byte("x"), []byte("y"))
+		if _, err := SendBatch(ctx, c, b); err == nil {
+			t.Fatalf("%s: expected an error", bad)
+		}
+		if got, want := received(), []string{"Sync"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got statements %q, want %q", bad, got, want)
+		}
+
+		b.SyncEach = true
+		results, err := SendBatch(ctx, c, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].Err != nil || results[1].Err == nil {
+			t.Errorf("%s: expected only the second statement to fail, got %+v", bad, results)
+		}
+		if got, want := received(), []string{"Sync", "INSERT 1", "Sync"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got statements %q, want %q", bad, got, want)
+		}
+	}
+
+	// Statements without []byte parameters are not described, so they may
+	// use tables created earlier in the batch.
+	b = &Batch{}
+	b.Queue("CREATE TABLE t (i int)")
+	b.Queue("INSERT INTO t VALUES ($1)", 1)
+	results, err := SendBatch(ctx, c, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil || results[1].Err != nil {
+		t.Errorf("unexpected errors: %+v", results)
+	}
+	wantQueries := []string{"CREATE TABLE t (i int)", "INSERT INTO t VALUES ($1)", "Sync"}
+	if got := received(); !reflect.DeepEqual(got, wantQueries) {
+		t.Errorf("got statements %q, want %q", got, wantQueries)
+	}
+
+	// The connection is usable afterwards.
+	b = &Batch{}
+	b.Queue("INSERT 3")
+	if results, err := SendBatch(ctx, c, b); err != nil || results[0].Err != nil {
+		t.Fatalf("unexpected error: %v %+v", err, results)
+	}
+	received()
+
+	// []byte parameters are sent like Exec sends them: in text, encoded for
+	// their types, unless binary_parameters is set.
+	tests := []struct {
+		binaryParameters bool
+		query            string
+		want             string
+	}{
+		{false, "SELECT $1", "bytes"},
+		{false, "SELECT $1::bytea", `\x6279746573`},
+		{true, "SELECT $1", "binary bytes"},
+		{true, "SELECT $1::bytea", "binary bytes"},
+	}
+	for _, tt := range tests {
+		connector, err := NewConnector(&Config{
+			User:             "u",
+			SSLMode:          "disable",
+			BinaryParameters: tt.binaryParameters,
+			Dialer:           fakeDialer{t: t, handler: batchServer(queries)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := sql.OpenDB(connector).Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &Batch{}
+		b.Queue(tt.query, []byte("bytes"))
+		results, err := SendBatch(ctx, c, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := results[0].Rows; !reflect.DeepEqual(got, [][]interface{}{{[]byte(tt.want)}}) {
+			t.Errorf("%s with binary_parameters %v: got %q, want %q", tt.query, tt.binaryParameters, got, tt.want)
+		}
+		c.Close()
+		received()
+	}
+}
+
+// A batch larger than the socket buffers must not deadlock, with the server
+// blocked on sending results which are not read until the batch is sent.
+func TestSendBatchLarge(t *testing.T) {
+	queries := make(chan string, 100000)
+	connector, err := NewConnector(&Config{
+		User:             "u",
+		SSLMode:          "disable",
+		BinaryParameters: true,
+		Dialer:           fakeDialer{t: t, handler: batchServer(queries)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	ctx := context.Background()
+	c, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	value := strings.Repeat("x", 1000)
+	b := &Batch{}
+	for i := 0; i < 20000; i++ {
+		b.Queue("SELECT $1", value)
+	}
+	results, err := SendBatch(ctx, c, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if r.Err != nil || len(r.Rows) != 1 || string(r.Rows[0][0].([]byte)) != value {
+			t.Fatalf("unexpected result %d: %+v", i, r)
+		}
+	}
+}
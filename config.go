@@ -0,0 +1,386 @@
+package pq
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds everything needed to establish connections to the server.  It
+// can be filled in by the application, or made from a connection string with
+// ParseConfig and then adjusted.  Use NewConnector to connect with it.
+//
+// The fields correspond to the connection parameters of the same names, which
+// are described in the package documentation.
+type Config struct {
+	// Hosts are tried in order until a connection is established which
+	// satisfies TargetSessionAttrs.  If empty, localhost is used.
+	Hosts []Host
+
+	User string
+
+	// Password is the password to authenticate with.  If it is empty and
+	// PasswordFunc is nil, the password is looked up in the password file,
+	// PGPASSFILE or ~/.pgpass, unless the Config was returned by ParseConfig
+	// for a connection string which set an empty password explicitly.
+	Password string
+
+	Database string
+
+	// ConnectTimeout limits the time spent establishing each connection.
+	// Like connect_timeout, it is rounded up to whole seconds.  Zero means
+	// wait indefinitely.
+	ConnectTimeout time.Duration
+
+	TargetSessionAttrs string
+	LoadBalanceHosts   string
+
+	SSLMode        string
+	SSLCert        string
+	SSLKey         string
+	SSLPassword    string
+	SSLRootCert    string
+	SSLCRL         string
+	SSLCRLDir      string
+	ChannelBinding string
+
+	// TLSConfig, if non-nil, is used for SSL connections instead of the
+	// configuration made from the SSL settings above.  SSLMode still decides
+	// whether SSL is used, but any verification of the server certificate is
+	// up to TLSConfig.  If its ServerName is empty, the host name is used.
+	TLSConfig *tls.Config
+
+	// RuntimeParams are sent to the server when connecting, e.g.
+	// application_name or search_path.  Values need no quoting or escaping.
+	RuntimeParams map[string]string
+
+	DisablePreparedBinaryResult bool
+	BinaryParameters            bool
+
+	// FetchSize, if positive, is the number of rows fetched at a time by
+	// queries in a transaction; see WithFetchSize.
+	FetchSize int
+
+	// NoticeHandler, if set, is called with the notices the server sends,
+	// e.g. the output of RAISE NOTICE or VACUUM VERBOSE, as they are
+	// received.  It runs on the goroutine using the connection at the time,
+	// except during COPY FROM STDIN, when it runs on the goroutine which
+	// receives the server's responses to the copied data.  It must not use
+	// the connection itself.
+	NoticeHandler func(*Error)
+
+	// NotificationHandler, if set, is called with the notifications received
+	// on channels the session LISTENs to, like NoticeHandler.
+	NotificationHandler func(*Notification)
+
+	// ParameterStatusHandler, if set, is called when the server reports a new
+	// value of a run-time parameter after the connection was made, like
+	// NoticeHandler.  See the ParameterStatus method of the connection.
+	ParameterStatusHandler func(name, value string)
+
+	// Dialer is used to open the network connections.  If nil, the net
+	// package is used directly.
+	Dialer Dialer
+
+	// PasswordFunc and SSLPasswordFunc are used like the fields of the same
+	// name of Driver.
+	PasswordFunc    PasswordFunc
+	SSLPasswordFunc SSLPasswordFunc
+
+	// passwordSet is set by ParseConfig if the connection string set the
+	// password, even to an empty one, which disables the password file.
+	passwordSet bool
+}
+
+// Host is one of the servers of a Config.
+type Host struct {
+	// Host is a host name, an IP address or the directory of a UNIX domain
+	// socket.  If empty, localhost is used.
+	Host string
+
+	// Hostaddr, if set, is the IP address to connect to instead of looking
+	// up Host.
+	Hostaddr string
+
+	// Port is the port number.  If zero, 5432 is used.
+	Port int
+}
+
+// ParseConfig parses a connection string in either of the forms accepted by
+// Open, and returns the resulting configuration.  As with Open, settings not
+// given in the connection string are taken from the environment and the
+// connection service file, and the defaults are applied.
+func ParseConfig(dsn string) (_ *Config, err error) {
+	defer errRecoverNoErrBadConn(&err)
+
+	o := make(values)
+
+	// A number of defaults are applied here, in this order:
+	//
+	// * Very low precedence defaults applied in every situation
+	// * Environment variables
+	// * The service in the connection service file, if one is selected
+	// * Explicitly passed connection information
+	o.Set("host", "localhost")
+	o.Set("port", "5432")
+	// N.B.: Extra float digits should be set to 3, but that breaks
+	// Postgres 8.4 and older, where the max is 2.
+	o.Set("extra_float_digits", "2")
+	for k, v := range parseEnviron(os.Environ()) {
+		o.Set(k, v)
+	}
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		dsn, err = ParseURL(dsn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	explicit := make(values)
+	if err := parseOpts(dsn, explicit); err != nil {
+		return nil, err
+	}
+	if service, ok := explicit["service"]; ok {
+		o.Set("service", service)
+	}
+	if service := o.Get("service"); service != "" {
+		if err := handleService(o, service); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range explicit {
+		o.Set(k, v)
+	}
+
+	// Use the "fallback" application name if necessary
+	if fallback := o.Get("fallback_application_name"); fallback != "" {
+		if !o.Isset("application_name") {
+			o.Set("application_name", fallback)
+		}
+	}
+
+	cfg := &Config{
+		User:               o.Get("user"),
+		Password:           o.Get("password"),
+		Database:           o.Get("dbname"),
+		TargetSessionAttrs: o.Get("target_session_attrs"),
+		LoadBalanceHosts:   o.Get("load_balance_hosts"),
+		SSLMode:            o.Get("sslmode"),
+		SSLCert:            o.Get("sslcert"),
+		SSLKey:             o.Get("sslkey"),
+		SSLPassword:        o.Get("sslpassword"),
+		SSLRootCert:        o.Get("sslrootcert"),
+		SSLCRL:             o.Get("sslcrl"),
+		SSLCRLDir:          o.Get("sslcrldir"),
+		ChannelBinding:     o.Get("channel_binding"),
+		RuntimeParams:      make(map[string]string),
+		passwordSet:        o.Isset("password"),
+	}
+	if err := cfg.handleDriverSettings(o); err != nil {
+		return nil, err
+	}
+	if timeout := o.Get("connect_timeout"); timeout != "" {
+		seconds, err := strconv.ParseInt(timeout, 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for parameter connect_timeout: %s", err)
+		}
+		cfg.ConnectTimeout = time.Duration(seconds) * time.Second
+	}
+
+	targets, err := splitHosts(o)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		port, err := strconv.Atoi(t.Get("port"))
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port number: %q", t.Get("port"))
+		}
+		cfg.Hosts = append(cfg.Hosts, Host{Host: t.Get("host"), Hostaddr: t.Get("hostaddr"), Port: port})
+	}
+
+	for k, v := range o {
+		if k != "user" && k != "dbname" && !isDriverSetting(k) {
+			cfg.RuntimeParams[k] = v
+		}
+	}
+
+	// If a user is not provided by any other means, the last
+	// resort is to use the current operating system provided user
+	// name.
+	if cfg.User == "" {
+		u, err := userCurrent()
+		if err != nil {
+			return nil, err
+		}
+		cfg.User = u
+	}
+
+	// Check the remaining settings now, rather than on the first connection
+	// attempt.
+	if _, err := cfg.values(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Handle driver-side settings in parsed connection string.
+func (c *Config) handleDriverSettings(o values) (err error) {
+	boolSetting := func(key string, val *bool) error {
+		if value := o.Get(key); value != "" {
+			if value == "yes" {
+				*val = true
+			} else if value == "no" {
+				*val = false
+			} else {
+				return fmt.Errorf("unrecognized value %q for %s", value, key)
+			}
+		}
+		return nil
+	}
+
+	err = boolSetting("disable_prepared_binary_result", &c.DisablePreparedBinaryResult)
+	if err != nil {
+		return err
+	}
+	err = boolSetting("binary_parameters", &c.BinaryParameters)
+	if err != nil {
+		return err
+	}
+	if value := o.Get("fetch_size"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid value for parameter fetch_size: %q", value)
+		}
+		c.FetchSize = n
+	}
+	return nil
+}
+
+// values checks the configuration, and returns it in the form of connection
+// parameters, with the defaults applied.
+func (c *Config) values() (values, error) {
+	o := make(values)
+
+	hosts := c.Hosts
+	if len(hosts) == 0 {
+		hosts = []Host{{}}
+	}
+	var hostList, hostaddrList, portList []string
+	hasHostaddr := false
+	for _, h := range hosts {
+		if strings.Contains(h.Host, ",") || strings.Contains(h.Hostaddr, ",") {
+			return nil, fmt.Errorf("invalid host %q", h.Host+h.Hostaddr)
+		}
+		if h.Port < 0 || h.Port > 65535 {
+			return nil, fmt.Errorf("invalid port number: %d", h.Port)
+		}
+		port := ""
+		if h.Port != 0 {
+			port = strconv.Itoa(h.Port)
+		}
+		hostList = append(hostList, h.Host)
+		hostaddrList = append(hostaddrList, h.Hostaddr)
+		portList = append(portList, port)
+		hasHostaddr = hasHostaddr || h.Hostaddr != ""
+	}
+	o.Set("host", strings.Join(hostList, ","))
+	if hasHostaddr {
+		o.Set("hostaddr", strings.Join(hostaddrList, ","))
+	}
+	o.Set("port", strings.Join(portList, ","))
+
+	for k, v := range c.RuntimeParams {
+		if k == "user" || k == "dbname" || k == "database" || isDriverSetting(k) {
+			return nil, fmt.Errorf("pq: %s is not a run-time parameter", k)
+		}
+		o.Set(k, v)
+	}
+
+	user := c.User
+	if user == "" {
+		u, err := userCurrent()
+		if err != nil {
+			return nil, err
+		}
+		user = u
+	}
+	o.Set("user", user)
+	setIf := func(key, value string) {
+		if value != "" {
+			o.Set(key, value)
+		}
+	}
+	if c.Password != "" || c.passwordSet {
+		o.Set("password", c.Password)
+	}
+	setIf("dbname", c.Database)
+	if c.ConnectTimeout > 0 {
+		seconds := (c.ConnectTimeout + time.Second - 1) / time.Second
+		o.Set("connect_timeout", strconv.FormatInt(int64(seconds), 10))
+	}
+	setIf("target_session_attrs", c.TargetSessionAttrs)
+	setIf("load_balance_hosts", c.LoadBalanceHosts)
+	setIf("sslmode", c.SSLMode)
+	setIf("sslcert", c.SSLCert)
+	setIf("sslkey", c.SSLKey)
+	setIf("sslpassword", c.SSLPassword)
+	setIf("sslrootcert", c.SSLRootCert)
+	setIf("sslcrl", c.SSLCRL)
+	setIf("sslcrldir", c.SSLCRLDir)
+	setIf("channel_binding", c.ChannelBinding)
+
+	if !o.Isset("extra_float_digits") {
+		o.Set("extra_float_digits", "2")
+	}
+	// We can't work with any client_encoding other than UTF-8 currently.
+	// However, we have historically allowed the user to set it to UTF-8
+	// explicitly, and there's no reason to break such programs, so allow that.
+	// Note that the "options" setting could also set client_encoding, but
+	// parsing its value is not worth it.  Instead, we always explicitly send
+	// client_encoding as a separate run-time parameter, which should override
+	// anything set in options.
+	if enc := o.Get("client_encoding"); enc != "" && !isUTF8(enc) {
+		return nil, errors.New("client_encoding must be absent or 'UTF8'")
+	}
+	o.Set("client_encoding", "UTF8")
+	// DateStyle needs a similar treatment.
+	if datestyle := o.Get("datestyle"); datestyle != "" {
+		if datestyle != "ISO, MDY" {
+			return nil, fmt.Errorf("setting datestyle must be absent or %v; got %v",
+				"ISO, MDY", datestyle)
+		}
+	} else {
+		o.Set("datestyle", "ISO, MDY")
+	}
+
+	switch cb := o.Get("channel_binding"); cb {
+	case "", "disable", "prefer", "require":
+	default:
+		return nil, fmt.Errorf(`unsupported channel_binding %q; only "prefer" (default), "require" and "disable" supported`, cb)
+	}
+	switch lb := o.Get("load_balance_hosts"); lb {
+	case "", "disable", "random":
+	default:
+		return nil, fmt.Errorf(`unsupported load_balance_hosts %q; only "disable" (default) and "random" supported`, lb)
+	}
+	switch attrs := o.Get("target_session_attrs"); attrs {
+	case "", "any", "read-write", "read-only", "primary", "standby", "prefer-standby":
+	default:
+		return nil, fmt.Errorf(`unsupported target_session_attrs %q; only "any" (default), "read-write", "read-only", "primary", "standby" and "prefer-standby" supported`, attrs)
+	}
+	return o, nil
+}
+
+// dialer returns the Dialer to use for new connections.
+func (c *Config) dialer() Dialer {
+	if c.Dialer == nil {
+		return defaultDialer{}
+	}
+	return c.Dialer
+}
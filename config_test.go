@@ -0,0 +1,134 @@
+package pq
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig("host=db1,/tmp,db3 hostaddr=10.0.0.1,, port=5433,,5434 " +
+		"user=u password=secret dbname=d connect_timeout=7 sslmode=verify-full " +
+		"sslrootcert=root.crt target_session_attrs=read-write binary_parameters=yes " +
+		"fetch_size=100 fallback_application_name=fallback search_path='a, b'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Host{
+		{Host: "db1", Hostaddr: "10.0.0.1", Port: 5433},
+		{Host: "/tmp", Port: 5432},
+		{Host: "db3", Port: 5434},
+	}
+	if !reflect.DeepEqual(cfg.Hosts, want) {
+		t.Errorf("Hosts: got %+v, want %+v", cfg.Hosts, want)
+	}
+	if cfg.User != "u" || cfg.Password != "secret" || cfg.Database != "d" {
+		t.Errorf("unexpected user %q, password %q or database %q", cfg.User, cfg.Password, cfg.Database)
+	}
+	if cfg.ConnectTimeout != 7*time.Second {
+		t.Errorf("ConnectTimeout: got %v", cfg.ConnectTimeout)
+	}
+	if cfg.SSLMode != "verify-full" || cfg.SSLRootCert != "root.crt" {
+		t.Errorf("unexpected sslmode %q or sslrootcert %q", cfg.SSLMode, cfg.SSLRootCert)
+	}
+	if cfg.TargetSessionAttrs != "read-write" {
+		t.Errorf("TargetSessionAttrs: got %q", cfg.TargetSessionAttrs)
+	}
+	if !cfg.BinaryParameters || cfg.DisablePreparedBinaryResult || cfg.FetchSize != 100 {
+		t.Errorf("unexpected driver settings %v, %v, %v", cfg.BinaryParameters, cfg.DisablePreparedBinaryResult, cfg.FetchSize)
+	}
+	for k, v := range map[string]string{
+		"application_name":   "fallback",
+		"search_path":        "a, b",
+		"extra_float_digits": "2",
+	} {
+		if got := cfg.RuntimeParams[k]; got != v {
+			t.Errorf("RuntimeParams[%q]: got %q, want %q", k, got, v)
+		}
+	}
+	for _, k := range []string{"user", "dbname", "password", "fallback_application_name", "sslmode", "fetch_size"} {
+		if _, ok := cfg.RuntimeParams[k]; ok {
+			t.Errorf("unexpected run-time parameter %q", k)
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		dsn string
+		err string
+	}{
+		{"port=abc", "invalid port number"},
+		{"host=a,b port=1,2,3", "could not match 3 port numbers to 2 hosts"},
+		{"binary_parameters=maybe", "unrecognized value"},
+		{"connect_timeout=soon", "connect_timeout"},
+		{"fetch_size=-1", "fetch_size"},
+		{"client_encoding=LATIN1", "client_encoding"},
+		{"datestyle='ISO, YDM'", "datestyle"},
+		{"target_session_attrs=primary-ish", "target_session_attrs"},
+		{"load_balance_hosts=roundrobin", "load_balance_hosts"},
+		{"channel_binding=always", "channel_binding"},
+	}
+	for _, tt := range tests {
+		_, err := ParseConfig("user=u " + tt.dsn)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.dsn, tt.err, err)
+		}
+	}
+}
+
+func TestConfigValues(t *testing.T) {
+	cfg := &Config{
+		Hosts:          []Host{{Host: "a"}, {Host: "b", Hostaddr: "10.0.0.2", Port: 6543}},
+		User:           "u",
+		ConnectTimeout: 1500 * time.Millisecond,
+		RuntimeParams:  map[string]string{"application_name": "it's an app"},
+	}
+	o, err := cfg.values()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := values{
+		"host":               "a,b",
+		"hostaddr":           ",10.0.0.2",
+		"port":               ",6543",
+		"user":               "u",
+		"connect_timeout":    "2",
+		"application_name":   "it's an app",
+		"extra_float_digits": "2",
+		"client_encoding":    "UTF8",
+		"datestyle":          "ISO, MDY",
+	}
+	if !reflect.DeepEqual(o, want) {
+		t.Errorf("got %v, want %v", o, want)
+	}
+
+	// An empty password is kept apart from none, since it disables the
+	// password file.
+	for _, tt := range []struct {
+		dsn string
+		set bool
+	}{
+		{"user=u", false},
+		{"user=u password=", true},
+		{"user=u password=''", true},
+	} {
+		cfg, err := ParseConfig(tt.dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := cfg.values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if password, set := o["password"]; set != tt.set || password != "" {
+			t.Errorf("%s: got password %q, set %v", tt.dsn, password, set)
+		}
+	}
+
+	cfg.RuntimeParams["sslmode"] = "disable"
+	if _, err := cfg.values(); err == nil || !strings.Contains(err.Error(), "sslmode is not a run-time parameter") {
+		t.Errorf("expected an error for sslmode in RuntimeParams, got %v", err)
+	}
+}
@@ -2,16 +2,20 @@ package pq
 
 import (
 	"bufio"
+	"context"
 	"crypto/md5"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
 	"database/sql/driver"
 	"encoding/binary"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
 	"os/user"
@@ -19,6 +23,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -34,14 +39,48 @@ var (
 	ErrCouldNotDetectUsername    = errors.New("pq: Could not detect default username. Please provide one explicitly.")
 )
 
-type drv struct{}
+// PasswordFunc returns the password to use when connecting to the server at
+// host and port as the given user.  host and port are the values in effect for
+// the connection attempt; host is a directory for UNIX domain sockets.
+//
+// ctx expires when the connect_timeout does, if one is set, which covers the
+// whole connection attempt, starting with dialing the server.
+type PasswordFunc func(ctx context.Context, host, port, user, dbname string) (string, error)
 
-func (d *drv) Open(name string) (driver.Conn, error) {
-	return Open(name)
+// SSLPasswordFunc returns the password to decrypt the SSL client key in file,
+// which is either the sslkey file or a PKCS#12 sslcert file.
+//
+// ctx expires when the connect_timeout does, if one is set, which covers the
+// whole connection attempt, starting with dialing the server.
+type SSLPasswordFunc func(ctx context.Context, file string) (string, error)
+
+// Driver is the Postgres database driver.  The zero value is the driver
+// registered with database/sql as "postgres".
+type Driver struct {
+	// PasswordFunc, if non-nil, is called every time a new connection is
+	// established, just before authenticating with the server.  The password
+	// it returns overrides any password from the connection string, the
+	// environment and the password file.  This can be used with credentials
+	// which are only valid for a limited time, such as access tokens.
+	//
+	// If PasswordFunc returns an error, the connection attempt fails with that
+	// error.
+	PasswordFunc PasswordFunc
+
+	// SSLPasswordFunc, if non-nil, is called to get the password for an
+	// encrypted SSL client key when the sslpassword setting is not set.
+	SSLPasswordFunc SSLPasswordFunc
+}
+
+// Open opens a new connection to the database.  name is a connection string.
+// Most users should only use it through database/sql package from the
+// standard library.
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	return dialOpen(defaultDialer{}, name, d)
 }
 
 func init() {
-	sql.Register("postgres", &drv{})
+	sql.Register("postgres", &Driver{})
 }
 
 type parameterStatus struct {
@@ -52,6 +91,14 @@ type parameterStatus struct {
 	// the current location based on the TimeZone value of the session, if
 	// available
 	currentLocation *time.Location
+
+	// the values of in_hot_standby and default_transaction_read_only, or ""
+	// if not reported by the server (before Postgres 14)
+	inHotStandby               string
+	defaultTransactionReadOnly string
+
+	// the values of all parameters reported by the server
+	params map[string]string
 }
 
 type transactionStatus byte
@@ -103,6 +150,22 @@ type conn struct {
 	saveMessageType   byte
 	saveMessageBuffer []byte
 
+	// The readers of the results of statements which have been sent with
+	// SendAsync, in the order the statements were sent.  Their results come
+	// before those of anything sent later, so recv1Buf runs them before
+	// receiving anything else; see readPending.
+	pending        []func()
+	readingPending bool
+
+	// The names of the savepoints created with savepoint in the current
+	// transaction, innermost last.
+	savepoints []string
+
+	// Set by prepareTransaction.  The transaction has then ended as far as
+	// the server is concerned, but not yet for database/sql, which still
+	// calls Commit or Rollback.
+	txnEnded bool
+
 	// If true, this connection is bad and all public-facing functions should
 	// return ErrBadConn.
 	bad bool
@@ -115,32 +178,29 @@ type conn struct {
 	// Whether to always send []byte parameters over as binary.  Enables single
 	// round-trip mode for non-prepared Query calls.
 	binaryParameters bool
-}
 
-// Handle driver-side settings in parsed connection string.
-func (c *conn) handleDriverSettings(o values) (err error) {
-	boolSetting := func(key string, val *bool) error {
-		if value := o.Get(key); value != "" {
-			if value == "yes" {
-				*val = true
-			} else if value == "no" {
-				*val = false
-			} else {
-				return fmt.Errorf("unrecognized value %q for %s", value, key)
-			}
-		}
-		return nil
-	}
+	// The default number of rows to fetch at a time in a transaction, or 0 to
+	// fetch all of them at once.
+	fetchSize int
 
-	err = boolSetting("disable_prepared_binary_result", &c.disablePreparedBinaryResult)
-	if err != nil {
-		return err
-	}
-	err = boolSetting("binary_parameters", &c.binaryParameters)
-	if err != nil {
-		return err
-	}
-	return nil
+	// If set, NoticeResponses are passed to it; see SetNoticeHandler.
+	noticeHandler func(*Error)
+
+	// If set, NotificationResponses are passed to it; see
+	// SetNotificationHandler.  notifications counts them.
+	notificationHandler func(*Notification)
+	notifications       int
+
+	// If set, called for new parameter values; see SetParameterStatusHandler.
+	parameterStatusHandler func(name, value string)
+
+	// The configuration and the settings for the host the connection was
+	// made with, and the key data sent by the backend.  These are needed to
+	// cancel statements; see cancel.
+	cfg       *Config
+	opts      values
+	processID int
+	secretKey int
 }
 
 func (c *conn) handlePgpass(o values) {
@@ -217,6 +277,95 @@ func (c *conn) handlePgpass(o values) {
 	}
 }
 
+// handleService adds the settings of service from the connection service
+// file to o.  The file named by PGSERVICEFILE, or ~/.pg_service.conf, is
+// searched first, and then pg_service.conf in PGSYSCONFDIR.  It is an error if
+// the service is not defined in either.
+func handleService(o values, service string) error {
+	var files []string
+	if filename := os.Getenv("PGSERVICEFILE"); filename != "" {
+		files = append(files, filename)
+	} else if user, err := user.Current(); err == nil {
+		// XXX this code doesn't work on Windows where the default filename is
+		// XXX %APPDATA%\postgresql\.pg_service.conf
+		files = append(files, filepath.Join(user.HomeDir, ".pg_service.conf"))
+	}
+	if dir := os.Getenv("PGSYSCONFDIR"); dir != "" {
+		files = append(files, filepath.Join(dir, "pg_service.conf"))
+	}
+
+	for _, filename := range files {
+		settings, err := readServiceFile(filename, service)
+		if err != nil {
+			return err
+		}
+		if settings != nil {
+			for k, v := range settings {
+				o.Set(k, v)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("pq: definition of service %q not found", service)
+}
+
+// readServiceFile returns the settings of service in the connection service
+// file filename, or nil if the file does not exist or does not define the
+// service.
+//
+// The file is in INI format: a line with the service name in brackets starts
+// the definition of a service, followed by lines of the form key=value.
+// Empty lines and lines starting with # are ignored.
+func readServiceFile(filename, service string) (values, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var settings values
+	inService := false
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			if inService {
+				// done with our service
+				break
+			}
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("pq: syntax error in service file %q, line %d", filename, lineno)
+			}
+			inService = strings.TrimSpace(line[1:len(line)-1]) == service
+			if inService {
+				settings = make(values)
+			}
+			continue
+		}
+		if !inService {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("pq: syntax error in service file %q, line %d", filename, lineno)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if key == "service" {
+			return nil, fmt.Errorf("pq: nested service specifications not supported in service file %q, line %d", filename, lineno)
+		}
+		settings[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
 func (c *conn) writeBuf(b byte) *writeBuf {
 	c.scratch[0] = b
 	return &writeBuf{
@@ -230,91 +379,151 @@ func Open(name string) (_ driver.Conn, err error) {
 }
 
 func DialOpen(d Dialer, name string) (_ driver.Conn, err error) {
+	return dialOpen(d, name, &Driver{})
+}
+
+func dialOpen(d Dialer, name string, drv *Driver) (_ driver.Conn, err error) {
+	cfg, err := ParseConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Dialer = d
+	cfg.PasswordFunc = drv.PasswordFunc
+	cfg.SSLPasswordFunc = drv.SSLPasswordFunc
+	cn, err := cfg.open(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return cn, nil
+}
+
+// open establishes a connection as configured by c.
+func (c *Config) open(ctx context.Context) (_ *conn, err error) {
 	// Handle any panics during connection initialization.  Note that we
 	// specifically do *not* want to use errRecover(), as that would turn any
 	// connection errors into ErrBadConns, hiding the real error message from
 	// the user.
 	defer errRecoverNoErrBadConn(&err)
 
-	o := make(values)
-
-	// A number of defaults are applied here, in this order:
-	//
-	// * Very low precedence defaults applied in every situation
-	// * Environment variables
-	// * Explicitly passed connection information
-	o.Set("host", "localhost")
-	o.Set("port", "5432")
-	// N.B.: Extra float digits should be set to 3, but that breaks
-	// Postgres 8.4 and older, where the max is 2.
-	o.Set("extra_float_digits", "2")
-	for k, v := range parseEnviron(os.Environ()) {
-		o.Set(k, v)
-	}
-
-	if strings.HasPrefix(name, "postgres://") || strings.HasPrefix(name, "postgresql://") {
-		name, err = ParseURL(name)
-		if err != nil {
-			return nil, err
-		}
+	o, err := c.values()
+	if err != nil {
+		return nil, err
 	}
-
-	if err := parseOpts(name, o); err != nil {
+	targets, err := splitHosts(o)
+	if err != nil {
 		return nil, err
 	}
-
-	// Use the "fallback" application name if necessary
-	if fallback := o.Get("fallback_application_name"); fallback != "" {
-		if !o.Isset("application_name") {
-			o.Set("application_name", fallback)
-		}
+	if o.Get("load_balance_hosts") == "random" {
+		targets = shuffleHosts(ctx, targets)
+	}
+	// With prefer-standby, we first look for a standby, and only if none is
+	// available settle for any server.
+	sessionAttrs := []string{o.Get("target_session_attrs")}
+	if sessionAttrs[0] == "prefer-standby" {
+		sessionAttrs = []string{"standby", "any"}
 	}
 
-	// We can't work with any client_encoding other than UTF-8 currently.
-	// However, we have historically allowed the user to set it to UTF-8
-	// explicitly, and there's no reason to break such programs, so allow that.
-	// Note that the "options" setting could also set client_encoding, but
-	// parsing its value is not worth it.  Instead, we always explicitly send
-	// client_encoding as a separate run-time parameter, which should override
-	// anything set in options.
-	if enc := o.Get("client_encoding"); enc != "" && !isUTF8(enc) {
-		return nil, errors.New("client_encoding must be absent or 'UTF8'")
+	// Try the hosts in order, and return the first connection which
+	// satisfies target_session_attrs.  If none does, the error from the last
+	// attempt is returned.
+	for _, attrs := range sessionAttrs {
+		for _, o := range targets {
+			var cn *conn
+			cn, err = connect(ctx, o, c)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err = cn.checkSessionAttrs(attrs); err != nil {
+				cn.c.Close()
+				continue
+			}
+			return cn, nil
+		}
 	}
-	o.Set("client_encoding", "UTF8")
-	// DateStyle needs a similar treatment.
-	if datestyle := o.Get("datestyle"); datestyle != "" {
-		if datestyle != "ISO, MDY" {
-			panic(fmt.Sprintf("setting datestyle must be absent or %v; got %v",
-				"ISO, MDY", datestyle))
+	return nil, err
+}
+
+// connect establishes a connection to the single host in o.  With
+// sslmode=allow or sslmode=prefer, a second connection attempt is made with
+// or without SSL, respectively, if the server rejects the first one.  With
+// sslmode=prefer, a failed SSL handshake also leads to a second attempt.
+func connect(ctx context.Context, o values, cfg *Config) (*conn, error) {
+	var fallback string
+	first := o.Copy()
+	switch o.Get("sslmode") {
+	case "allow":
+		first.Set("sslmode", "disable")
+		// SSL is not supported over UNIX domain sockets; see dial
+		if ntw, _ := network(o); ntw != "unix" {
+			fallback = "require"
 		}
-	} else {
-		o.Set("datestyle", "ISO, MDY")
+	case "prefer":
+		fallback = "disable"
 	}
+	cn, err := connectOnce(ctx, first, cfg)
+	switch err.(type) {
+	case *Error, sslHandshakeError:
+	default:
+		return cn, err
+	}
+	if fallback != "" && first.Get("sslmode") != fallback {
+		o = o.Copy()
+		o.Set("sslmode", fallback)
+		return connectOnce(ctx, o, cfg)
+	}
+	return cn, err
+}
 
-	// If a user is not provided by any other means, the last
-	// resort is to use the current operating system provided user
-	// name.
-	if o.Get("user") == "" {
-		u, err := userCurrent()
-		if err != nil {
-			return nil, err
-		} else {
-			o.Set("user", u)
+func connectOnce(ctx context.Context, o values, cfg *Config) (_ *conn, err error) {
+	cn := &conn{
+		disablePreparedBinaryResult: cfg.DisablePreparedBinaryResult,
+		binaryParameters:            cfg.BinaryParameters,
+		fetchSize:                   cfg.FetchSize,
+		noticeHandler:               cfg.NoticeHandler,
+		notificationHandler:         cfg.NotificationHandler,
+		parameterStatusHandler:      cfg.ParameterStatusHandler,
+		cfg:                         cfg,
+		opts:                        o,
+	}
+	canceled := func() bool { return false }
+	defer func() {
+		if canceled() {
+			err = ctx.Err()
+		}
+		if err != nil && cn.c != nil {
+			cn.c.Close()
 		}
+	}()
+	defer errRecoverNoErrBadConn(&err)
+
+	if cfg.PasswordFunc == nil {
+		cn.handlePgpass(o)
 	}
 
-	cn := &conn{}
-	err = cn.handleDriverSettings(o)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// The callbacks made while connecting share the connect_timeout of the
+	// attempt, which starts with dial.
+	callbackCtx, cancel, err := connectContext(ctx, o)
 	if err != nil {
 		return nil, err
 	}
-	cn.handlePgpass(o)
-
-	cn.c, err = dial(d, o)
+	defer cancel()
+	cn.c, err = dial(cfg.dialer(), o)
 	if err != nil {
 		return nil, err
 	}
-	cn.ssl(o)
+	canceled = watchConnect(ctx, cn.c)
+	if cfg.PasswordFunc != nil {
+		if err := cn.callPasswordFunc(callbackCtx, o, cfg.PasswordFunc); err != nil {
+			return nil, err
+		}
+	}
+	cn.ssl(callbackCtx, o, cfg)
 	cn.buf = bufio.NewReader(cn.c)
 	cn.startup(o)
 
@@ -325,6 +534,194 @@ func DialOpen(d Dialer, name string) (_ driver.Conn, err error) {
 	return cn, err
 }
 
+// watchConnect closes c if ctx is done before the connection has been
+// established, which aborts the connection attempt.  The returned function
+// must be called once the attempt is over; it reports whether c was closed.
+func watchConnect(ctx context.Context, c net.Conn) func() bool {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	finished := make(chan struct{})
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+			closed <- true
+		case <-finished:
+			closed <- false
+		}
+	}()
+	return func() bool {
+		close(finished)
+		return <-closed
+	}
+}
+
+// splitHosts returns a copy of o for each of the hosts in the comma-separated
+// host list.  The port setting may either be a single port used for all hosts,
+// or a list with one port per host.  Empty entries in either list are replaced
+// by the defaults.  hostaddr, if set, must list an address for every host.
+func splitHosts(o values) ([]values, error) {
+	hosts := strings.Split(o.Get("host"), ",")
+	var hostaddrs []string
+	if hostaddr := o.Get("hostaddr"); hostaddr != "" {
+		hostaddrs = strings.Split(hostaddr, ",")
+		if len(hosts) == 1 {
+			for len(hosts) < len(hostaddrs) {
+				hosts = append(hosts, hosts[0])
+			}
+		} else if len(hostaddrs) != len(hosts) {
+			return nil, fmt.Errorf("could not match %d host names to %d hostaddr values", len(hosts), len(hostaddrs))
+		}
+	}
+	ports := strings.Split(o.Get("port"), ",")
+	if len(ports) == 1 {
+		for len(ports) < len(hosts) {
+			ports = append(ports, ports[0])
+		}
+	} else if len(ports) != len(hosts) {
+		return nil, fmt.Errorf("could not match %d port numbers to %d hosts", len(ports), len(hosts))
+	}
+
+	targets := make([]values, len(hosts))
+	for i := range hosts {
+		t := o.Copy()
+		t.Set("host", hosts[i])
+		if hosts[i] == "" {
+			t.Set("host", "localhost")
+		}
+		t.Set("port", ports[i])
+		if ports[i] == "" {
+			t.Set("port", "5432")
+		}
+		delete(t, "hostaddr")
+		if hostaddrs != nil && hostaddrs[i] != "" {
+			t.Set("hostaddr", hostaddrs[i])
+		}
+		targets[i] = t
+	}
+	return targets, nil
+}
+
+// lookupHost is used to resolve host names for load balancing.  It can be
+// replaced in tests.
+var lookupHost = net.DefaultResolver.LookupHost
+
+var hostRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// shuffleHosts implements load_balance_hosts=random.  Every target whose host
+// is a name is replaced with one target for each address the name resolves
+// to, keeping the name for SSL verification and the password file, and the
+// result is put in random order.  Names which cannot be resolved are kept as
+// they are, so that connecting to them reports the error.  Each lookup is
+// bounded by the connect_timeout of its target.
+func shuffleHosts(ctx context.Context, targets []values) []values {
+	var resolved []values
+	for _, t := range targets {
+		host := t.Get("host")
+		if t.Get("hostaddr") != "" || strings.HasPrefix(host, "/") || net.ParseIP(host) != nil {
+			resolved = append(resolved, t)
+			continue
+		}
+		addrs, err := lookupTargetHost(ctx, t)
+		if err != nil || len(addrs) == 0 {
+			resolved = append(resolved, t)
+			continue
+		}
+		for _, addr := range addrs {
+			r := t.Copy()
+			r.Set("hostaddr", addr)
+			resolved = append(resolved, r)
+		}
+	}
+
+	hostRand.Lock()
+	perm := hostRand.Perm(len(resolved))
+	hostRand.Unlock()
+	shuffled := make([]values, len(resolved))
+	for i, j := range perm {
+		shuffled[i] = resolved[j]
+	}
+	return shuffled
+}
+
+// lookupTargetHost resolves the host of t within the connect_timeout of t.
+func lookupTargetHost(ctx context.Context, t values) ([]string, error) {
+	ctx, cancel, err := connectContext(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	return lookupHost(ctx, t.Get("host"))
+}
+
+// checkSessionAttrs returns an error if the session does not satisfy the
+// target_session_attrs value attrs.
+func (cn *conn) checkSessionAttrs(attrs string) (err error) {
+	defer errRecoverNoErrBadConn(&err)
+
+	switch attrs {
+	case "read-write", "read-only":
+		readOnly := cn.isReadOnly()
+		if attrs == "read-write" && readOnly {
+			return errors.New("pq: session is read-only")
+		} else if attrs == "read-only" && !readOnly {
+			return errors.New("pq: session is not read-only")
+		}
+	case "primary", "standby":
+		standby := cn.isStandby()
+		if attrs == "primary" && standby {
+			return errors.New("pq: server is in hot standby mode")
+		} else if attrs == "standby" && !standby {
+			return errors.New("pq: server is not in hot standby mode")
+		}
+	}
+	return nil
+}
+
+// isReadOnly returns whether the session defaults to read-only transactions.
+// Servers since Postgres 14 report this; for older servers, we have to ask.
+func (cn *conn) isReadOnly() bool {
+	ps := cn.parameterStatus
+	if ps.inHotStandby != "" && ps.defaultTransactionReadOnly != "" {
+		return ps.inHotStandby == "on" || ps.defaultTransactionReadOnly == "on"
+	}
+	return cn.queryBool("SHOW transaction_read_only")
+}
+
+// isStandby returns whether the server is in hot standby mode.
+func (cn *conn) isStandby() bool {
+	if cn.parameterStatus.inHotStandby != "" {
+		return cn.parameterStatus.inHotStandby == "on"
+	}
+	return cn.queryBool("SELECT pg_catalog.pg_is_in_recovery()")
+}
+
+// queryBool runs q, which must return a single boolean or "on"/"off" value.
+func (cn *conn) queryBool(q string) bool {
+	rows, err := cn.simpleQuery(q)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil {
+		panic(err)
+	}
+	switch v := dest[0].(type) {
+	case bool:
+		return v
+	case []byte:
+		return string(v) == "on"
+	}
+	errorf("unexpected result %#v from %q", dest[0], q)
+	panic("not reached")
+}
+
 func dial(d Dialer, o values) (net.Conn, error) {
 	ntw, addr := network(o)
 	// SSL is not necessary or supported over UNIX domain sockets
@@ -354,9 +751,39 @@ func dial(d Dialer, o values) (net.Conn, error) {
 	return d.Dial(ntw, addr)
 }
 
+// callPasswordFunc asks passwordFunc for the password to use for this
+// connection, and stores it in o.
+func (c *conn) callPasswordFunc(ctx context.Context, o values, passwordFunc PasswordFunc) error {
+	password, err := passwordFunc(ctx, o.Get("host"), o.Get("port"), o.Get("user"), o.Get("dbname"))
+	if err != nil {
+		return err
+	}
+	o.Set("password", password)
+	return nil
+}
+
+// connectContext returns a context derived from ctx, which expires after the
+// connect_timeout in o, if one is given, counting from now.
+func connectContext(ctx context.Context, o values) (context.Context, context.CancelFunc, error) {
+	if timeout := o.Get("connect_timeout"); timeout != "" && timeout != "0" {
+		seconds, err := strconv.ParseInt(timeout, 10, 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid value for parameter connect_timeout: %s", err)
+		}
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, cancel, nil
+}
+
 func network(o values) (string, string) {
 	host := o.Get("host")
 
+	if addr := o.Get("hostaddr"); addr != "" {
+		return "tcp", net.JoinHostPort(addr, o.Get("port"))
+	}
+
 	if strings.HasPrefix(host, "/") {
 		sockPath := path.Join(host, ".s.PGSQL."+o.Get("port"))
 		return "unix", sockPath
@@ -380,6 +807,14 @@ func (vs values) Isset(k string) bool {
 	return ok
 }
 
+func (vs values) Copy() values {
+	c := make(values, len(vs))
+	for k, v := range vs {
+		c[k] = v
+	}
+	return c
+}
+
 // scanner implements a tokenizer for libpq-style option strings.
 type scanner struct {
 	s []rune
@@ -491,9 +926,20 @@ func parseOpts(name string, o values) error {
 	return nil
 }
 
+// transactionStatus returns the transaction status, once the results of the
+// statements sent with SendAsync which are still to be read, and may change
+// it, have been read.
+func (cn *conn) transactionStatus() transactionStatus {
+	if len(cn.pending) > 0 && !cn.readingPending {
+		cn.readPending(len(cn.pending))
+	}
+	return cn.txnStatus
+}
+
 func (cn *conn) isInTransaction() bool {
-	return cn.txnStatus == txnStatusIdleInTransaction ||
-		cn.txnStatus == txnStatusInFailedTransaction
+	status := cn.transactionStatus()
+	return status == txnStatusIdleInTransaction ||
+		status == txnStatusInFailedTransaction
 }
 
 func (cn *conn) checkIsInTransaction(intxn bool) {
@@ -504,13 +950,22 @@ func (cn *conn) checkIsInTransaction(intxn bool) {
 }
 
 func (cn *conn) Begin() (_ driver.Tx, err error) {
+	return cn.begin("")
+}
+
+// begin starts a transaction with the given transaction modes, e.g.
+// " READ ONLY".
+func (cn *conn) begin(mode string) (_ driver.Tx, err error) {
 	if cn.bad {
 		return nil, driver.ErrBadConn
 	}
 	defer cn.errRecover(&err)
 
 	cn.checkIsInTransaction(false)
-	_, commandTag, err := cn.simpleExec("BEGIN")
+	// A transaction prepared without a driver Tx to end leaves txnEnded set,
+	// which must not end this one.
+	cn.txnEnded = false
+	_, commandTag, err := cn.simpleExec("BEGIN" + mode)
 	if err != nil {
 		return nil, err
 	}
@@ -531,6 +986,9 @@ func (cn *conn) Commit() (err error) {
 	}
 	defer cn.errRecover(&err)
 
+	if cn.endPreparedTransaction() {
+		return nil
+	}
 	cn.checkIsInTransaction(true)
 	// We don't want the client to think that everything is okay if it tries
 	// to commit a failed transaction.  However, no matter what we return,
@@ -566,6 +1024,9 @@ func (cn *conn) Rollback() (err error) {
 	}
 	defer cn.errRecover(&err)
 
+	if cn.endPreparedTransaction() {
+		return nil
+	}
 	cn.checkIsInTransaction(true)
 	_, commandTag, err := cn.simpleExec("ROLLBACK")
 	if err != nil {
@@ -577,10 +1038,153 @@ func (cn *conn) Rollback() (err error) {
 	if commandTag != "ROLLBACK" {
 		return fmt.Errorf("unexpected command tag %s", commandTag)
 	}
-	cn.checkIsInTransaction(false)
+	cn.checkIsInTransaction(false)
+	return nil
+}
+
+// prepareTransaction prepares the current transaction for two-phase commit
+// under the global transaction identifier gid.  If the transaction has
+// failed, it is rolled back instead, and ErrInFailedTransaction is returned.
+// Afterwards, even if preparing failed, the transaction has ended, and
+// Commit and Rollback have nothing left to do.
+func (cn *conn) prepareTransaction(gid string) (err error) {
+	if cn.bad {
+		return driver.ErrBadConn
+	}
+	defer cn.errRecover(&err)
+
+	cn.checkIsInTransaction(true)
+	if cn.txnStatus == txnStatusInFailedTransaction {
+		if err := cn.Rollback(); err != nil {
+			return err
+		}
+		cn.txnEnded = true
+		return ErrInFailedTransaction
+	}
+	_, commandTag, err := cn.simpleExec("PREPARE TRANSACTION " + quoteLiteral(gid))
+	if err != nil {
+		// The server ends the transaction if it can't prepare it.
+		if cn.isInTransaction() {
+			cn.bad = true
+		} else {
+			cn.txnEnded = true
+		}
+		return err
+	}
+	if commandTag != "PREPARE TRANSACTION" {
+		cn.bad = true
+		return fmt.Errorf("unexpected command tag %s", commandTag)
+	}
+	cn.checkIsInTransaction(false)
+	cn.txnEnded = true
+	return nil
+}
+
+// endPreparedTransaction returns true if the transaction has been ended by
+// prepareTransaction, in which case there is nothing left to do for Commit
+// and Rollback.  A prepared transaction remains until it is committed or
+// rolled back with COMMIT PREPARED or ROLLBACK PREPARED.
+func (cn *conn) endPreparedTransaction() bool {
+	if !cn.txnEnded {
+		return false
+	}
+	cn.txnEnded = false
+	cn.checkIsInTransaction(false)
+	return true
+}
+
+// savepoint creates a savepoint named name in the current transaction.
+func (cn *conn) savepoint(name string) (err error) {
+	if cn.bad {
+		return driver.ErrBadConn
+	}
+	defer cn.errRecover(&err)
+
+	cn.checkIsInTransaction(true)
+	if cn.txnStatus == txnStatusInFailedTransaction {
+		return ErrInFailedTransaction
+	}
+	_, commandTag, err := cn.simpleExec("SAVEPOINT " + QuoteIdentifier(name))
+	if err != nil {
+		return err
+	}
+	if commandTag != "SAVEPOINT" {
+		cn.bad = true
+		return fmt.Errorf("unexpected command tag %s", commandTag)
+	}
+	cn.savepoints = append(cn.savepoints, name)
+	return nil
+}
+
+// releaseSavepoint releases the savepoint named name, and any savepoints
+// created after it.  The changes made since are kept.
+func (cn *conn) releaseSavepoint(name string) (err error) {
+	if cn.bad {
+		return driver.ErrBadConn
+	}
+	defer cn.errRecover(&err)
+
+	cn.checkIsInTransaction(true)
+	i, err := cn.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+	if cn.txnStatus == txnStatusInFailedTransaction {
+		return ErrInFailedTransaction
+	}
+	_, commandTag, err := cn.simpleExec("RELEASE SAVEPOINT " + QuoteIdentifier(name))
+	if err != nil {
+		return err
+	}
+	if commandTag != "RELEASE" {
+		cn.bad = true
+		return fmt.Errorf("unexpected command tag %s", commandTag)
+	}
+	cn.savepoints = cn.savepoints[:i]
+	return nil
+}
+
+// rollbackToSavepoint undoes the changes made since the savepoint named name
+// was created, and releases any savepoints created after it.  The savepoint
+// itself remains.  This also recovers a failed transaction, as long as the
+// failure happened after the savepoint was created.
+func (cn *conn) rollbackToSavepoint(name string) (err error) {
+	if cn.bad {
+		return driver.ErrBadConn
+	}
+	defer cn.errRecover(&err)
+
+	cn.checkIsInTransaction(true)
+	i, err := cn.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+	_, commandTag, err := cn.simpleExec("ROLLBACK TO SAVEPOINT " + QuoteIdentifier(name))
+	if err != nil {
+		return err
+	}
+	if commandTag != "ROLLBACK" {
+		cn.bad = true
+		return fmt.Errorf("unexpected command tag %s", commandTag)
+	}
+	if cn.txnStatus != txnStatusIdleInTransaction {
+		cn.bad = true
+		return fmt.Errorf("unexpected transaction status %v", cn.txnStatus)
+	}
+	cn.savepoints = cn.savepoints[:i+1]
 	return nil
 }
 
+// findSavepoint returns the index of the innermost savepoint named name.
+func (cn *conn) findSavepoint(name string) (int, error) {
+	for i := len(cn.savepoints) - 1; i >= 0; i-- {
+		if cn.savepoints[i] == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("pq: savepoint %q does not exist", name)
+}
+
 func (cn *conn) gname() string {
 	cn.namei++
 	return strconv.FormatInt(int64(cn.namei), 10)
@@ -630,6 +1234,12 @@ func (cn *conn) simpleQuery(q string) (res *rows, err error) {
 				cn.bad = true
 				errorf("unexpected message %q in simple query execution", t)
 			}
+			if res != nil && !res.done {
+				// A result set without any rows.  Other statements may
+				// follow, so kick off to Next, rather than skipping it.
+				cn.saveMessage(t, r)
+				return
+			}
 			if res == nil {
 				res = &rows{
 					cn: cn,
@@ -765,12 +1375,28 @@ func (cn *conn) Close() (err error) {
 }
 
 // Implement the "Queryer" interface
-func (cn *conn) Query(query string, args []driver.Value) (_ driver.Rows, err error) {
+func (cn *conn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	r, err := cn.query(query, args, cn.fetchSize)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// query runs query with args.  If fetchSize is positive and a transaction
+// is running, the rows are fetched fetchSize at a time.
+func (cn *conn) query(query string, args []driver.Value, fetchSize int) (_ *rows, err error) {
 	if cn.bad {
 		return nil, driver.ErrBadConn
 	}
 	defer cn.errRecover(&err)
 
+	if fetchSize > 0 && cn.transactionStatus() == txnStatusIdleInTransaction {
+		// Only the extended query protocol can fetch the rows in chunks.
+		st := cn.prepareTo(query, "")
+		return st.queryPortal(args, fetchSize)
+	}
+
 	// Check to see if we can use the "simpleQuery" interface, which is
 	// *much* faster than going through prepare/exec
 	if len(args) == 0 {
@@ -788,13 +1414,7 @@ func (cn *conn) Query(query string, args []driver.Value) (_ driver.Rows, err err
 		return rows, nil
 	} else {
 		st := cn.prepareTo(query, "")
-		st.exec(args)
-		return &rows{
-			cn:       cn,
-			colNames: st.colNames,
-			colTyps:  st.colTyps,
-			colFmts:  st.colFmts,
-		}, nil
+		return st.queryPortal(args, 0)
 	}
 }
 
@@ -876,6 +1496,18 @@ func (cn *conn) saveMessage(typ byte, buf *readBuf) {
 	cn.saveMessageBuffer = *buf
 }
 
+// readPending runs the first n pending result readers.
+func (cn *conn) readPending(n int) {
+	cn.readingPending = true
+	defer func() { cn.readingPending = false }()
+	for ; n > 0 && len(cn.pending) > 0; n-- {
+		read := cn.pending[0]
+		cn.pending[0] = nil
+		cn.pending = cn.pending[1:]
+		read()
+	}
+}
+
 // recvMessage receives any message from the backend, or returns an error if
 // a problem occurred while reading the message.
 func (cn *conn) recvMessage(r *readBuf) (byte, error) {
@@ -913,8 +1545,8 @@ func (cn *conn) recvMessage(r *readBuf) (byte, error) {
 
 // recv receives a message from the backend, but if an error happened while
 // reading the message or the received message was an ErrorResponse, it panics.
-// NoticeResponses are ignored.  This function should generally be used only
-// during the startup sequence.
+// NoticeResponses are passed to the notice handler.  This function should
+// generally be used only during the startup sequence.
 func (cn *conn) recv() (t byte, r *readBuf) {
 	for {
 		var err error
@@ -928,7 +1560,7 @@ func (cn *conn) recv() (t byte, r *readBuf) {
 		case 'E':
 			panic(parseError(r))
 		case 'N':
-			// ignore
+			cn.processNotice(r)
 		default:
 			return
 		}
@@ -938,6 +1570,9 @@ func (cn *conn) recv() (t byte, r *readBuf) {
 // recv1Buf is exactly equivalent to recv1, except it uses a buffer supplied by
 // the caller to avoid an allocation.
 func (cn *conn) recv1Buf(r *readBuf) byte {
+	if len(cn.pending) > 0 && !cn.readingPending {
+		cn.readPending(len(cn.pending))
+	}
 	for {
 		t, err := cn.recvMessage(r)
 		if err != nil {
@@ -945,8 +1580,10 @@ func (cn *conn) recv1Buf(r *readBuf) byte {
 		}
 
 		switch t {
-		case 'A', 'N':
-			// ignore
+		case 'A':
+			cn.processNotification(r)
+		case 'N':
+			cn.processNotice(r)
 		case 'S':
 			cn.processParameterStatus(r)
 		default:
@@ -956,19 +1593,20 @@ func (cn *conn) recv1Buf(r *readBuf) byte {
 }
 
 // recv1 receives a message from the backend, panicking if an error occurs
-// while attempting to read it.  All asynchronous messages are ignored, with
-// the exception of ErrorResponse.
+// while attempting to read it.  Asynchronous messages are processed: notices
+// and notifications are passed to their handlers.
 func (cn *conn) recv1() (t byte, r *readBuf) {
 	r = &readBuf{}
 	t = cn.recv1Buf(r)
 	return t, r
 }
 
-func (cn *conn) ssl(o values) {
+func (cn *conn) ssl(ctx context.Context, o values, cfg *Config) {
 	verifyCaOnly := false
-	tlsConf := tls.Config{}
-	switch mode := o.Get("sslmode"); mode {
-	case "require", "":
+	tlsConf := &tls.Config{}
+	mode := o.Get("sslmode")
+	switch mode {
+	case "require", "prefer", "":
 		tlsConf.InsecureSkipVerify = true
 	case "verify-ca":
 		// We must skip TLS's own verification since it requires full
@@ -980,11 +1618,28 @@ func (cn *conn) ssl(o values) {
 	case "disable":
 		return
 	default:
-		errorf(`unsupported sslmode %q; only "require" (default), "verify-full", "verify-ca", and "disable" supported`, mode)
+		errorf(`unsupported sslmode %q; only "require" (default), "verify-full", "verify-ca", "prefer", "allow", and "disable" supported`, mode)
 	}
 
-	cn.setupSSLClientCertificates(&tlsConf, o)
-	cn.setupSSLCA(&tlsConf, o)
+	var crls []*pkix.CertificateList
+	if cfg.TLSConfig != nil {
+		// The application's configuration replaces ours entirely, except
+		// that we fill in the server name.
+		tlsConf = cfg.TLSConfig.Clone()
+		if tlsConf.ServerName == "" {
+			tlsConf.ServerName = o.Get("host")
+		}
+		verifyCaOnly = false
+	} else {
+		cn.setupSSLClientCertificates(ctx, tlsConf, o, cfg.SSLPasswordFunc)
+		cn.setupSSLCA(tlsConf, o)
+		crls = cn.setupSSLCRL(o)
+		if len(crls) > 0 && mode == "verify-full" {
+			tlsConf.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+				return checkCRLs(crls, verifiedChains)
+			}
+		}
+	}
 
 	w := cn.writeBuf(0)
 	w.int32(80877103)
@@ -996,21 +1651,43 @@ func (cn *conn) ssl(o values) {
 		panic(err)
 	}
 
-	if b[0] != 'S' {
+	if b[0] == 'N' && mode == "prefer" {
+		// Carry on without SSL.  Record that in o, so that connect knows
+		// there is no point in trying again without SSL.
+		o["sslmode"] = "disable"
+		return
+	} else if b[0] != 'S' {
 		panic(ErrSSLNotSupported)
 	}
 
-	client := tls.Client(cn.c, &tlsConf)
+	client := tls.Client(cn.c, tlsConf)
 	if verifyCaOnly {
-		cn.verifyCA(client, &tlsConf)
+		cn.verifyCA(client, tlsConf, crls)
+	} else if mode == "prefer" {
+		// Shake hands now rather than on the first write, so that connect
+		// can tell the failure apart and try again without SSL.
+		if err := client.Handshake(); err != nil {
+			panic(sslHandshakeError{err})
+		}
 	}
 	cn.c = client
 }
 
+// sslHandshakeError is the error of a failed SSL handshake with
+// sslmode=prefer.
+type sslHandshakeError struct {
+	err error
+}
+
+func (e sslHandshakeError) Error() string {
+	return e.err.Error()
+}
+
 // verifyCA carries out a TLS handshake to the server and verifies the
 // presented certificate against the effective CA, i.e. the one specified in
-// sslrootcert or the system CA if sslrootcert was not specified.
-func (cn *conn) verifyCA(client *tls.Conn, tlsConf *tls.Config) {
+// sslrootcert or the system CA if sslrootcert was not specified, and against
+// the certificate revocation lists in crls.
+func (cn *conn) verifyCA(client *tls.Conn, tlsConf *tls.Config, crls []*pkix.CertificateList) {
 	err := client.Handshake()
 	if err != nil {
 		panic(err)
@@ -1027,10 +1704,16 @@ func (cn *conn) verifyCA(client *tls.Conn, tlsConf *tls.Config) {
 		}
 		opts.Intermediates.AddCert(cert)
 	}
-	_, err = certs[0].Verify(opts)
+	chains, err := certs[0].Verify(opts)
 	if err != nil {
 		panic(err)
 	}
+	if len(crls) > 0 {
+		err = checkCRLs(crls, chains)
+		if err != nil {
+			panic(err)
+		}
+	}
 }
 
 // This function sets up SSL client certificates based on either the "sslkey"
@@ -1040,11 +1723,22 @@ func (cn *conn) verifyCA(client *tls.Conn, tlsConf *tls.Config) {
 // explicitly, the files must exist.  The key file must also not be
 // world-readable, or this function will panic with
 // ErrSSLKeyHasWorldPermissions.
-func (cn *conn) setupSSLClientCertificates(tlsConf *tls.Config, o values) {
+//
+// If "sslcert" is a PKCS#12 file, recognized by its .p12 or .pfx extension,
+// both the certificate and the key are loaded from it, and "sslkey" is not
+// used.  Encrypted keys are decrypted with the password in "sslpassword", or
+// the one returned by sslPasswordFunc.
+func (cn *conn) setupSSLClientCertificates(ctx context.Context, tlsConf *tls.Config, o values, sslPasswordFunc SSLPasswordFunc) {
 	var missingOk bool
 
 	sslkey := o.Get("sslkey")
 	sslcert := o.Get("sslcert")
+	isPKCS12 := false
+	switch strings.ToLower(filepath.Ext(sslcert)) {
+	case ".p12", ".pfx":
+		isPKCS12 = true
+		sslkey = sslcert
+	}
 	if sslkey != "" && sslcert != "" {
 		// If the user has set an sslkey and sslcert, they *must* exist.
 		missingOk = false
@@ -1066,7 +1760,7 @@ func (cn *conn) setupSSLClientCertificates(tlsConf *tls.Config, o values) {
 	// Check that both files exist, and report the error or stop, depending on
 	// which behaviour we want.  Note that we don't do any more extensive
 	// checks than this (such as checking that the paths aren't directories);
-	// LoadX509KeyPair() will take care of the rest.
+	// loading the key pair will take care of the rest.
 	keyfinfo, err := os.Stat(sslkey)
 	if err != nil && missingOk {
 		return
@@ -1086,7 +1780,18 @@ func (cn *conn) setupSSLClientCertificates(tlsConf *tls.Config, o values) {
 		panic(ErrSSLKeyHasWorldPermissions)
 	}
 
-	cert, err := tls.LoadX509KeyPair(sslcert, sslkey)
+	password := func(file string) (string, error) {
+		if sslpassword := o.Get("sslpassword"); sslpassword != "" || sslPasswordFunc == nil {
+			return sslpassword, nil
+		}
+		return sslPasswordFunc(ctx, file)
+	}
+	var cert tls.Certificate
+	if isPKCS12 {
+		cert, err = loadPKCS12(sslcert, password)
+	} else {
+		cert, err = loadSSLKeyPair(sslcert, sslkey, password)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -1110,25 +1815,138 @@ func (cn *conn) setupSSLCA(tlsConf *tls.Config, o values) {
 	}
 }
 
+// setupSSLCRL loads the certificate revocation lists from the file in sslcrl
+// and from all files in the directory in sslcrldir.  The files may contain
+// any number of PEM encoded CRLs, or a single DER encoded one.  Like libpq,
+// files in sslcrldir which do not contain CRLs are skipped.
+func (cn *conn) setupSSLCRL(o values) []*pkix.CertificateList {
+	var crls []*pkix.CertificateList
+	if sslcrl := o.Get("sslcrl"); sslcrl != "" {
+		data, err := ioutil.ReadFile(sslcrl)
+		if err != nil {
+			panic(err)
+		}
+		crls, err = parseCRLs(data)
+		if err != nil {
+			errorf("couldn't parse CRL in %s: %s", sslcrl, err)
+		}
+	}
+	if sslcrldir := o.Get("sslcrldir"); sslcrldir != "" {
+		entries, err := ioutil.ReadDir(sslcrldir)
+		if err != nil {
+			panic(err)
+		}
+		for _, e := range entries {
+			if !e.Mode().IsRegular() {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(sslcrldir, e.Name()))
+			if err != nil {
+				panic(err)
+			}
+			if dirCRLs, err := parseCRLs(data); err == nil {
+				crls = append(crls, dirCRLs...)
+			}
+		}
+	}
+	return crls
+}
+
+// parseCRLs parses the PEM encoded CRLs in data, or if there are none, the
+// single DER encoded one.
+func parseCRLs(data []byte) ([]*pkix.CertificateList, error) {
+	var crls []*pkix.CertificateList
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseDERCRL(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		crl, err := x509.ParseDERCRL(data)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+// checkCRLs returns an error unless there is a chain in verifiedChains in
+// which no certificate has been revoked.  Like libpq, every certificate but
+// the root must be covered by a current CRL from its issuer.
+func checkCRLs(crls []*pkix.CertificateList, verifiedChains [][]*x509.Certificate) error {
+	var err error
+	for _, chain := range verifiedChains {
+		if err = checkChainCRLs(crls, chain); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func checkChainCRLs(crls []*pkix.CertificateList, chain []*x509.Certificate) error {
+	now := time.Now()
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		found := false
+		for _, crl := range crls {
+			if issuer.CheckCRLSignature(crl) != nil {
+				continue
+			}
+			if crl.HasExpired(now) {
+				return fmt.Errorf("pq: CRL issued by %q has expired", issuer.Subject.CommonName)
+			}
+			found = true
+			for _, revoked := range crl.TBSCertList.RevokedCertificates {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("pq: certificate %q has been revoked", cert.Subject.CommonName)
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("pq: no CRL found for certificates issued by %q", issuer.Subject.CommonName)
+		}
+	}
+	return nil
+}
+
 // isDriverSetting returns true iff a setting is purely for configuring the
 // driver's options and should not be sent to the server in the connection
 // startup packet.
 func isDriverSetting(key string) bool {
 	switch key {
-	case "host", "port":
+	case "host", "hostaddr", "port":
+		return true
+	case "service":
 		return true
 	case "password":
 		return true
-	case "sslmode", "sslcert", "sslkey", "sslrootcert":
+	case "sslmode", "sslcert", "sslkey", "sslpassword", "sslrootcert", "sslcrl", "sslcrldir":
+		return true
+	case "channel_binding":
 		return true
 	case "fallback_application_name":
 		return true
 	case "connect_timeout":
 		return true
+	case "target_session_attrs", "load_balance_hosts":
+		return true
 	case "disable_prepared_binary_result":
 		return true
 	case "binary_parameters":
 		return true
+	case "fetch_size":
+		return true
 
 	default:
 		return false
@@ -1158,14 +1976,17 @@ func (cn *conn) startup(o values) {
 	w.string("")
 	cn.sendStartupPacket(w)
 
+	a := &AuthExchange{cn: cn, o: o}
 	for {
 		t, r := cn.recv()
 		switch t {
 		case 'K':
+			cn.processID = r.int32()
+			cn.secretKey = r.int32()
 		case 'S':
 			cn.processParameterStatus(r)
 		case 'R':
-			cn.auth(r, o)
+			cn.auth(r, a)
 		case 'Z':
 			cn.processReadyForQuery(r)
 			return
@@ -1175,42 +1996,6 @@ func (cn *conn) startup(o values) {
 	}
 }
 
-func (cn *conn) auth(r *readBuf, o values) {
-	switch code := r.int32(); code {
-	case 0:
-		// OK
-	case 3:
-		w := cn.writeBuf('p')
-		w.string(o.Get("password"))
-		cn.send(w)
-
-		t, r := cn.recv()
-		if t != 'R' {
-			errorf("unexpected password response: %q", t)
-		}
-
-		if r.int32() != 0 {
-			errorf("unexpected authentication response: %q", t)
-		}
-	case 5:
-		s := string(r.next(4))
-		w := cn.writeBuf('p')
-		w.string("md5" + md5s(md5s(o.Get("password")+o.Get("user"))+s))
-		cn.send(w)
-
-		t, r := cn.recv()
-		if t != 'R' {
-			errorf("unexpected password response: %q", t)
-		}
-
-		if r.int32() != 0 {
-			errorf("unexpected authentication response: %q", t)
-		}
-	default:
-		errorf("unknown authentication response: %d", code)
-	}
-}
-
 type format int
 
 const formatText format = 0
@@ -1266,19 +2051,48 @@ func (st *stmt) Close() (err error) {
 	return nil
 }
 
-func (st *stmt) Query(v []driver.Value) (r driver.Rows, err error) {
+func (st *stmt) Query(v []driver.Value) (driver.Rows, error) {
+	r, err := st.query(v, st.cn.fetchSize)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// query runs the statement with v.  If fetchSize is positive and a
+// transaction is running, the rows are fetched fetchSize at a time.
+func (st *stmt) query(v []driver.Value, fetchSize int) (_ *rows, err error) {
 	if st.cn.bad {
 		return nil, driver.ErrBadConn
 	}
 	defer st.cn.errRecover(&err)
 
-	st.exec(v)
-	return &rows{
+	return st.queryPortal(v, fetchSize)
+}
+
+// queryPortal is query without the error handling.
+func (st *stmt) queryPortal(v []driver.Value, fetchSize int) (*rows, error) {
+	rows := &rows{
 		cn:       st.cn,
 		colNames: st.colNames,
 		colTyps:  st.colTyps,
 		colFmts:  st.colFmts,
-	}, nil
+	}
+	if fetchSize > 0 && st.cn.transactionStatus() == txnStatusIdleInTransaction {
+		// The unnamed portal would be replaced by any statement run before
+		// the rows are closed.
+		rows.portal = "p" + st.cn.gname()
+		rows.fetchSize = fetchSize
+	}
+	st.exec(v, rows.portal, rows.fetchSize)
+	if rows.portal != "" {
+		// Receive the first chunk right away, like the following ones, so
+		// that other statements can run before Next is called.
+		if err := rows.receiveChunk(); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
 }
 
 func (st *stmt) Exec(v []driver.Value) (res driver.Result, err error) {
@@ -1287,12 +2101,14 @@ func (st *stmt) Exec(v []driver.Value) (res driver.Result, err error) {
 	}
 	defer st.cn.errRecover(&err)
 
-	st.exec(v)
+	st.exec(v, "", 0)
 	res, _, err = st.cn.readExecuteResponse("simple query")
 	return res, err
 }
 
-func (st *stmt) exec(v []driver.Value) {
+// exec binds v to the statement as the portal named portal, and executes it,
+// fetching at most maxRows rows unless maxRows is 0.
+func (st *stmt) exec(v []driver.Value, portal string, maxRows int) {
 	if len(v) >= 65536 {
 		errorf("got %d parameters but PostgreSQL only supports 65535 parameters", len(v))
 	}
@@ -1302,29 +2118,15 @@ func (st *stmt) exec(v []driver.Value) {
 
 	cn := st.cn
 	w := cn.writeBuf('B')
-	w.byte(0) // unnamed portal
+	w.string(portal)
 	w.string(st.name)
 
-	if cn.binaryParameters {
-		cn.sendBinaryParameters(w, v)
-	} else {
-		w.int16(0)
-		w.int16(len(v))
-		for i, x := range v {
-			if x == nil {
-				w.int32(-1)
-			} else {
-				b := encode(&cn.parameterStatus, x, st.paramTyps[i])
-				w.int32(len(b))
-				w.bytes(b)
-			}
-		}
-	}
+	cn.sendParameters(w, v, st.paramTyps)
 	w.bytes(st.colFmtData)
 
 	w.next('E')
-	w.byte(0)
-	w.int32(0)
+	w.string(portal)
+	w.int32(maxRows)
 
 	w.next('S')
 	cn.send(w)
@@ -1394,16 +2196,48 @@ type rows struct {
 	colFmts  []format
 	done     bool
 	rb       readBuf
+
+	// If set, called once the statement is over, with its error if any; it
+	// returns the error to report instead.  See watchCancel.
+	finish func(error) error
+
+	// The description of the next result set of a multi-statement simple
+	// query, once Next has reached the end of the current one; see
+	// NextResultSet.
+	next *rowDescription
+
+	// If portal is set, the rows are fetched fetchSize at a time from the
+	// portal of that name.  Each chunk is received completely, so that other
+	// statements can run in the transaction until the next one is needed.
+	// suspended is set while the portal has more rows.
+	portal    string
+	fetchSize int
+	chunk     []readBuf
+	suspended bool
+}
+
+type rowDescription struct {
+	colNames []string
+	colFmts  []format
+	colTyps  []oid.Oid
 }
 
-func (rs *rows) Close() error {
+func (rs *rows) Close() (err error) {
+	defer func() { err = rs.finished(err) }()
+	if rs.portal != "" {
+		return rs.closePortal()
+	}
 	// no need to look at cn.bad as Next() will
 	for {
 		err := rs.Next(nil)
 		switch err {
 		case nil:
 		case io.EOF:
-			return nil
+			// Next also returns io.EOF at the end of each result set but the
+			// last, so keep going until ReadyForQuery.
+			if rs.done {
+				return nil
+			}
 		default:
 			return err
 		}
@@ -1423,8 +2257,29 @@ func (rs *rows) Next(dest []driver.Value) (err error) {
 	if conn.bad {
 		return driver.ErrBadConn
 	}
+	defer func() {
+		if err != nil && err != io.EOF {
+			err = rs.finished(err)
+		}
+	}()
 	defer conn.errRecover(&err)
 
+	if rs.portal != "" {
+		for len(rs.chunk) == 0 {
+			if rs.done {
+				return io.EOF
+			}
+			if err := rs.fetch(); err != nil {
+				return err
+			}
+		}
+		rs.rb = rs.chunk[0]
+		rs.chunk[0] = nil
+		rs.chunk = rs.chunk[1:]
+		rs.decodeRow(dest)
+		return nil
+	}
+
 	for {
 		t := conn.recv1Buf(&rs.rb)
 		switch t {
@@ -1440,29 +2295,125 @@ func (rs *rows) Next(dest []driver.Value) (err error) {
 			}
 			return io.EOF
 		case 'D':
-			n := rs.rb.int16()
 			if err != nil {
 				conn.bad = true
 				errorf("unexpected DataRow after error %s", err)
 			}
-			if n < len(dest) {
-				dest = dest[:n]
-			}
-			for i := range dest {
-				l := rs.rb.int32()
-				if l == -1 {
-					dest[i] = nil
-					continue
-				}
-				dest[i] = decode(&conn.parameterStatus, rs.rb.next(l), rs.colTyps[i], rs.colFmts[i])
-			}
+			rs.decodeRow(dest)
 			return
+		case 'T':
+			// The next statement of a multi-statement simple query returns
+			// rows as well.
+			next := &rowDescription{}
+			next.colNames, next.colFmts, next.colTyps = parsePortalRowDescribe(&rs.rb)
+			rs.next = next
+			return io.EOF
+		default:
+			errorf("unexpected message after execute: %q", t)
+		}
+	}
+}
+
+// finished calls rs.finish, if it has not been called yet, with err, and
+// returns the error to report.
+func (rs *rows) finished(err error) error {
+	if finish := rs.finish; finish != nil {
+		rs.finish = nil
+		return finish(err)
+	}
+	return err
+}
+
+// decodeRow decodes the DataRow message in rs.rb into dest.
+func (rs *rows) decodeRow(dest []driver.Value) {
+	n := rs.rb.int16()
+	if n < len(dest) {
+		dest = dest[:n]
+	}
+	for i := range dest {
+		l := rs.rb.int32()
+		if l == -1 {
+			dest[i] = nil
+			continue
+		}
+		dest[i] = decode(&rs.cn.parameterStatus, rs.rb.next(l), rs.colTyps[i], rs.colFmts[i])
+	}
+}
+
+// fetch asks for the next chunk of rows from the portal, and receives it.
+func (rs *rows) fetch() error {
+	conn := rs.cn
+	w := conn.writeBuf('E')
+	w.string(rs.portal)
+	w.int32(rs.fetchSize)
+	w.next('S')
+	conn.send(w)
+	rs.suspended = false
+	return rs.receiveChunk()
+}
+
+// receiveChunk receives a chunk of rows from the portal, up to
+// ReadyForQuery.
+func (rs *rows) receiveChunk() (err error) {
+	conn := rs.cn
+	for {
+		t := conn.recv1Buf(&rs.rb)
+		switch t {
+		case 'D':
+			// The buffer is reused by the next message.
+			rs.chunk = append(rs.chunk, append(readBuf(nil), rs.rb...))
+		case 's':
+			// PortalSuspended; the portal has more rows.
+			rs.suspended = true
+		case 'C', 'I':
+		case 'E':
+			err = parseError(&rs.rb)
+		case 'Z':
+			conn.processReadyForQuery(&rs.rb)
+			if err != nil {
+				rs.chunk = nil
+				rs.suspended = false
+			}
+			rs.done = !rs.suspended
+			return err
 		default:
+			conn.bad = true
 			errorf("unexpected message after execute: %q", t)
 		}
 	}
 }
 
+// closePortal closes the rows of a portal.  The portal is closed on the
+// server as well, unless the transaction has ended or failed, which closes
+// it anyway.
+func (rs *rows) closePortal() (err error) {
+	conn := rs.cn
+	if conn.bad {
+		return driver.ErrBadConn
+	}
+	defer conn.errRecover(&err)
+
+	rs.chunk = nil
+	rs.done = true
+	rs.suspended = false
+	portal := rs.portal
+	rs.portal = ""
+
+	if conn.txnStatus == txnStatusIdleInTransaction {
+		w := conn.writeBuf('C')
+		w.byte('P')
+		w.string(portal)
+		w.next('S')
+		conn.send(w)
+		if t, _ := conn.recv1(); t != '3' {
+			conn.bad = true
+			errorf("unexpected close response: %q", t)
+		}
+		conn.readReadyForQuery()
+	}
+	return nil
+}
+
 // QuoteIdentifier quotes an "identifier" (e.g. a table or a column name) to be
 // used as part of an SQL statement.  For example:
 //
@@ -1481,6 +2432,18 @@ func QuoteIdentifier(name string) string {
 	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
 }
 
+// quoteLiteral quotes a string literal for use in statements which don't take
+// parameters.
+func quoteLiteral(s string) string {
+	s = strings.Replace(s, `'`, `''`, -1)
+	if strings.Contains(s, `\`) {
+		// Use an escape string, which is interpreted the same way regardless
+		// of standard_conforming_strings.
+		return `E'` + strings.Replace(s, `\`, `\\`, -1) + `'`
+	}
+	return `'` + s + `'`
+}
+
 func md5s(s string) string {
 	h := md5.New()
 	h.Write([]byte(s))
@@ -1522,60 +2485,203 @@ func (cn *conn) sendBinaryParameters(b *writeBuf, args []driver.Value) {
 	}
 }
 
+// sendParameters appends the parameter formats and values of a Bind message
+// for args to b.  With binary_parameters, they are sent as described for
+// sendBinaryParameters; otherwise they are all sent in text, encoded for the
+// parameter types paramTyps of the statement.  paramTyps may be nil if no
+// parameter is a []byte, the encoding of which depends on its type.
+func (cn *conn) sendParameters(b *writeBuf, args []driver.Value, paramTyps []oid.Oid) {
+	if cn.binaryParameters {
+		cn.sendBinaryParameters(b, args)
+		return
+	}
+	b.int16(0)
+	b.int16(len(args))
+	for i, x := range args {
+		if x == nil {
+			b.int32(-1)
+		} else {
+			var typ oid.Oid
+			if paramTyps != nil {
+				typ = paramTyps[i]
+			}
+			datum := encode(&cn.parameterStatus, x, typ)
+			b.int32(len(datum))
+			b.bytes(datum)
+		}
+	}
+}
+
 func (cn *conn) sendBinaryModeQuery(query string, args []driver.Value) {
 	if len(args) >= 65536 {
 		errorf("got %d parameters but PostgreSQL only supports 65535 parameters", len(args))
 	}
 
-	b := cn.writeBuf('P')
-	b.byte(0) // unnamed statement
-	b.string(query)
-	b.int16(0)
+	b := cn.writeQuery(nil, query, args, nil)
+	b.next('S')
+	cn.send(b)
+}
 
-	b.next('B')
-	b.int16(0) // unnamed portal and statement
-	cn.sendBinaryParameters(b, args)
-	b.bytes(colFmtDataAllText)
+// writeQuery appends the messages which run query with args, using the
+// unnamed statement and portal, to w, or to a new buffer if w is nil.  A Sync
+// message is not appended.  The parameters are sent untyped; see
+// sendParameters for paramTyps.
+func (cn *conn) writeQuery(w *writeBuf, query string, args []driver.Value, paramTyps []oid.Oid) *writeBuf {
+	if w == nil {
+		w = cn.writeBuf('P')
+	} else {
+		w.next('P')
+	}
+	w.byte(0) // unnamed statement
+	w.string(query)
+	w.int16(0)
 
-	b.next('D')
-	b.byte('P')
-	b.byte(0) // unnamed portal
+	w.next('B')
+	w.int16(0) // unnamed portal and statement
+	cn.sendParameters(w, args, paramTyps)
+	w.bytes(colFmtDataAllText)
 
-	b.next('E')
-	b.byte(0)
-	b.int32(0)
+	w.next('D')
+	w.byte('P')
+	w.byte(0) // unnamed portal
 
-	b.next('S')
-	cn.send(b)
+	w.next('E')
+	w.byte(0)
+	w.int32(0)
+	return w
 }
 
 func (c *conn) processParameterStatus(r *readBuf) {
 	var err error
 
 	param := r.string()
+	value := r.string()
+	old, reported := c.parameterStatus.params[param]
+	if c.parameterStatus.params == nil {
+		c.parameterStatus.params = make(map[string]string)
+	}
+	c.parameterStatus.params[param] = value
+
 	switch param {
 	case "server_version":
-		var major1 int
-		var major2 int
-		var minor int
-		_, err = fmt.Sscanf(r.string(), "%d.%d.%d", &major1, &major2, &minor)
-		if err == nil {
-			c.parameterStatus.serverVersion = major1*10000 + major2*100 + minor
-		}
+		c.parameterStatus.serverVersion = parseServerVersion(value)
 
 	case "TimeZone":
-		c.parameterStatus.currentLocation, err = time.LoadLocation(r.string())
+		c.parameterStatus.currentLocation, err = time.LoadLocation(value)
 		if err != nil {
 			c.parameterStatus.currentLocation = nil
 		}
 
+	case "in_hot_standby":
+		c.parameterStatus.inHotStandby = value
+
+	case "default_transaction_read_only":
+		c.parameterStatus.defaultTransactionReadOnly = value
+
 	default:
 		// ignore
 	}
+
+	// The transaction status is only known once the startup is over.
+	if h := c.parameterStatusHandler; h != nil && c.txnStatus != 0 && (!reported || old != value) {
+		h(param, value)
+	}
+}
+
+// parseServerVersion parses a server_version into the format of
+// server_version_num, or returns 0 if it can't.  Since Postgres 10, the
+// version has only two parts, e.g. "14.5", and there may be more text after
+// it, e.g. "14.5 (Debian 14.5-1.pgdg110+1)" or "9.6beta1".
+func parseServerVersion(version string) int {
+	var major, minor, patch int
+	n, _ := fmt.Sscanf(version, "%d.%d.%d", &major, &minor, &patch)
+	switch {
+	case n == 3:
+		return major*10000 + minor*100 + patch
+	case n == 2 && major >= 10:
+		return major*10000 + minor
+	case n == 2:
+		return major*10000 + minor*100
+	case n == 1 && major >= 10:
+		// e.g. "16devel"
+		return major * 10000
+	}
+	return 0
+}
+
+// ParameterStatus returns the value of the run-time parameter name last
+// reported by the server, and whether it was reported.  The server reports
+// some parameters, e.g. server_version, standard_conforming_strings,
+// application_name, is_superuser or in_hot_standby, when the connection is
+// made and whenever they change.  With database/sql, this and the other
+// methods about parameters are called through sql.Conn.Raw:
+//
+//	var version int
+//	err := c.Raw(func(driverConn interface{}) error {
+//		version = driverConn.(interface{ ServerVersion() int }).ServerVersion()
+//		return nil
+//	})
+func (cn *conn) ParameterStatus(name string) (string, bool) {
+	value, ok := cn.parameterStatus.params[name]
+	return value, ok
+}
+
+// ParameterStatuses returns the values of all run-time parameters reported
+// by the server, by name.  The map is a copy.
+func (cn *conn) ParameterStatuses() map[string]string {
+	params := make(map[string]string, len(cn.parameterStatus.params))
+	for k, v := range cn.parameterStatus.params {
+		params[k] = v
+	}
+	return params
+}
+
+// ServerVersion returns the version of the server in the format of
+// server_version_num, e.g. 140005 for 14.5 or 90624 for 9.6.24, or 0 if it is
+// unknown.
+func (cn *conn) ServerVersion() int {
+	return cn.parameterStatus.serverVersion
+}
+
+// SetParameterStatusHandler sets the function which is called when the
+// server reports a new value of a run-time parameter after the connection
+// was made, e.g. because of a SET statement, or removes it if handler is
+// nil.  This overrides Config.ParameterStatusHandler, and like
+// SetNoticeHandler, the handler remains set after the sql.Conn is closed.
+func (cn *conn) SetParameterStatusHandler(handler func(name, value string)) {
+	cn.parameterStatusHandler = handler
+}
+
+// processNotice passes a NoticeResponse to the notice handler, if any.
+func (cn *conn) processNotice(r *readBuf) {
+	if h := cn.noticeHandler; h != nil {
+		h(parseError(r))
+	}
+}
+
+// SetNoticeHandler sets the function the notices sent by the server on this
+// connection are passed to, or discards them if handler is nil.  This
+// overrides Config.NoticeHandler.  With database/sql, it is called through
+// sql.Conn.Raw:
+//
+//	err := c.Raw(func(driverConn interface{}) error {
+//		driverConn.(interface{ SetNoticeHandler(func(*pq.Error)) }).SetNoticeHandler(handler)
+//		return nil
+//	})
+//
+// The handler remains set after the sql.Conn is closed and the connection
+// goes back to the pool of the sql.DB, so a handler for a single session
+// should be removed before.
+func (cn *conn) SetNoticeHandler(handler func(*Error)) {
+	cn.noticeHandler = handler
 }
 
 func (c *conn) processReadyForQuery(r *readBuf) {
 	c.txnStatus = transactionStatus(r.byte())
+	// Savepoints don't survive the end of the transaction, however it ended.
+	if c.txnStatus == txnStatusIdle {
+		c.savepoints = nil
+	}
 }
 
 func (cn *conn) readReadyForQuery() {
@@ -1681,7 +2787,7 @@ func (cn *conn) postExecuteWorkaround() {
 			err := parseError(r)
 			cn.readReadyForQuery()
 			panic(err)
-		case 'C', 'D', 'I':
+		case 'C', 'D', 'I', 's':
 			// the query didn't fail, but we can't process this message
 			cn.saveMessage(t, r)
 			return
@@ -1782,7 +2888,7 @@ func parseEnviron(env []string) (out map[string]string) {
 		case "PGHOST":
 			accrue("host")
 		case "PGHOSTADDR":
-			unsupported()
+			accrue("hostaddr")
 		case "PGPORT":
 			accrue("port")
 		case "PGDATABASE":
@@ -1791,7 +2897,9 @@ func parseEnviron(env []string) (out map[string]string) {
 			accrue("user")
 		case "PGPASSWORD":
 			accrue("password")
-		case "PGSERVICE", "PGSERVICEFILE", "PGREALM":
+		case "PGSERVICE":
+			accrue("service")
+		case "PGREALM":
 			unsupported()
 		case "PGOPTIONS":
 			accrue("options")
@@ -1805,7 +2913,11 @@ func parseEnviron(env []string) (out map[string]string) {
 			accrue("sslkey")
 		case "PGSSLROOTCERT":
 			accrue("sslrootcert")
-		case "PGREQUIRESSL", "PGSSLCRL":
+		case "PGSSLCRL":
+			accrue("sslcrl")
+		case "PGSSLCRLDIR":
+			accrue("sslcrldir")
+		case "PGREQUIRESSL":
 			unsupported()
 		case "PGREQUIREPEER":
 			unsupported()
@@ -1813,6 +2925,10 @@ func parseEnviron(env []string) (out map[string]string) {
 			unsupported()
 		case "PGCONNECT_TIMEOUT":
 			accrue("connect_timeout")
+		case "PGTARGETSESSIONATTRS":
+			accrue("target_session_attrs")
+		case "PGLOADBALANCEHOSTS":
+			accrue("load_balance_hosts")
 		case "PGCLIENTENCODING":
 			accrue("client_encoding")
 		case "PGDATESTYLE":
@@ -1821,7 +2937,7 @@ func parseEnviron(env []string) (out map[string]string) {
 			accrue("timezone")
 		case "PGGEQO":
 			accrue("geqo")
-		case "PGSYSCONFDIR", "PGLOCALEDIR":
+		case "PGLOCALEDIR":
 			unsupported()
 		}
 	}
@@ -0,0 +1,346 @@
+//go:build go1.8
+// +build go1.8
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// cancelTimeout limits the time spent sending a CancelRequest.
+const cancelTimeout = 10 * time.Second
+
+// Implement the "QueryerContext" interface
+func (cn *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	list, err := namedValueToValue(args)
+	if err != nil {
+		return nil, err
+	}
+	finish, err := cn.watchCancel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := cn.query(query, list, fetchSize(ctx, cn.fetchSize))
+	if err != nil {
+		return nil, canceledError(finish(), err)
+	}
+	r.finish = func(err error) error { return canceledError(finish(), err) }
+	return r, nil
+}
+
+// Implement the "ExecerContext" interface
+func (cn *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	list, err := namedValueToValue(args)
+	if err != nil {
+		return nil, err
+	}
+	finish, err := cn.watchCancel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := cn.Exec(query, list)
+	return res, canceledError(finish(), err)
+}
+
+// Implement the "ConnPrepareContext" interface
+func (cn *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	finish, err := cn.watchCancel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st, err := cn.Prepare(query)
+	if err = canceledError(finish(), err); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// TxOptions holds transaction options which sql.TxOptions has no field for.
+// Attach them to the context passed to BeginTx with WithTxOptions.
+type TxOptions struct {
+	// Deferrable makes the transaction DEFERRABLE.  A SERIALIZABLE READ ONLY
+	// DEFERRABLE transaction may block when it starts, but then runs without
+	// the overhead of serializable isolation and cannot fail with a
+	// serialization error.  For other transactions, it has no effect.
+	Deferrable bool
+}
+
+type txOptionsKey struct{}
+
+// WithTxOptions returns a copy of ctx which carries opts.  Transactions begun
+// with it use opts in addition to the sql.TxOptions given to BeginTx:
+//
+//	ctx := pq.WithTxOptions(ctx, pq.TxOptions{Deferrable: true})
+//	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true})
+func WithTxOptions(ctx context.Context, opts TxOptions) context.Context {
+	return context.WithValue(ctx, txOptionsKey{}, opts)
+}
+
+type fetchSizeKey struct{}
+
+// WithFetchSize returns a copy of ctx which makes queries run with it fetch
+// n rows at a time, rather than all of them at once.  This overrides the
+// fetch_size connection parameter; 0 fetches all rows at once.
+//
+// The fetch size only applies in a transaction, since the rows are fetched
+// from a portal which lasts until the end of the transaction.  The rows of
+// each chunk are received completely before the first of them is returned,
+// so other statements can be run in the transaction while the rows are
+// open.
+func WithFetchSize(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, fetchSizeKey{}, n)
+}
+
+// fetchSize returns the fetch size set on ctx, or def.
+func fetchSize(ctx context.Context, def int) int {
+	if n, ok := ctx.Value(fetchSizeKey{}).(int); ok {
+		return n
+	}
+	return def
+}
+
+// Implement the "ConnBeginTx" interface
+func (cn *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	mode, err := transactionModes(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	finish, err := cn.watchCancel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := cn.begin(mode)
+	if err = canceledError(finish(), err); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// transactionModes returns the transaction modes for BEGIN which implement
+// opts and the TxOptions in ctx.
+func transactionModes(ctx context.Context, opts driver.TxOptions) (string, error) {
+	var mode string
+	switch level := sql.IsolationLevel(opts.Isolation); level {
+	case sql.LevelDefault:
+	case sql.LevelReadUncommitted:
+		mode = " ISOLATION LEVEL READ UNCOMMITTED"
+	case sql.LevelReadCommitted:
+		mode = " ISOLATION LEVEL READ COMMITTED"
+	case sql.LevelRepeatableRead:
+		mode = " ISOLATION LEVEL REPEATABLE READ"
+	case sql.LevelSerializable:
+		mode = " ISOLATION LEVEL SERIALIZABLE"
+	default:
+		return "", fmt.Errorf("pq: isolation level not supported: %v", level)
+	}
+	if opts.ReadOnly {
+		mode += " READ ONLY"
+	}
+	if pqOpts, _ := ctx.Value(txOptionsKey{}).(TxOptions); pqOpts.Deferrable {
+		mode += " DEFERRABLE"
+	}
+	return mode, nil
+}
+
+// Implement the "StmtQueryContext" interface
+func (st *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	list, err := namedValueToValue(args)
+	if err != nil {
+		return nil, err
+	}
+	finish, err := st.cn.watchCancel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := st.query(list, fetchSize(ctx, st.cn.fetchSize))
+	if err != nil {
+		return nil, canceledError(finish(), err)
+	}
+	r.finish = func(err error) error { return canceledError(finish(), err) }
+	return r, nil
+}
+
+// Implement the "StmtExecContext" interface
+func (st *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	list, err := namedValueToValue(args)
+	if err != nil {
+		return nil, err
+	}
+	finish, err := st.cn.watchCancel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := st.Exec(list)
+	return res, canceledError(finish(), err)
+}
+
+// Implement the "RowsNextResultSet" interface
+func (rs *rows) HasNextResultSet() bool {
+	return rs.next != nil
+}
+
+// NextResultSet advances to the rows of the next statement of a
+// multi-statement simple query which returns rows, skipping any remaining
+// rows of the current statement.  Statements which don't return rows, such
+// as INSERTs without RETURNING, don't have a result set.
+func (rs *rows) NextResultSet() error {
+	for rs.next == nil {
+		if rs.done {
+			return io.EOF
+		}
+		if err := rs.Next(nil); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	rs.colNames, rs.colFmts, rs.colTyps = rs.next.colNames, rs.next.colFmts, rs.next.colTyps
+	rs.next = nil
+	return nil
+}
+
+func namedValueToValue(named []driver.NamedValue) ([]driver.Value, error) {
+	args := make([]driver.Value, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			return nil, errors.New("pq: named parameters are not supported")
+		}
+		args[i] = nv.Value
+	}
+	return args, nil
+}
+
+// watchCancel watches ctx while cn runs a statement.  If ctx is done before
+// the statement is over, the server is asked to cancel it.  The statement
+// then fails with a query_canceled error, after which the connection can be
+// used normally again.
+//
+// The returned function must be called once the statement is over.  It
+// returns ctx.Err() if the statement was canceled, and nil otherwise.  If ctx
+// is already done, watchCancel returns ctx.Err() instead.
+func (cn *conn) watchCancel(ctx context.Context) (func() error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	done := ctx.Done()
+	if done == nil {
+		return func() error { return nil }, nil
+	}
+	finished := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		select {
+		case <-done:
+			// ctx can't be used for the cancel request, since it is done.
+			// Errors are ignored; the statement just runs to completion.
+			cancelCtx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+			cn.cancel(cancelCtx)
+			cancel()
+			result <- ctx.Err()
+		case <-finished:
+			result <- nil
+		}
+	}()
+	return func() error {
+		close(finished)
+		return <-result
+	}, nil
+}
+
+// canceledError returns the error to report for a statement which returned
+// err, given the result of the function returned by watchCancel.  If the
+// statement failed because it was canceled, that's ctxErr.
+func canceledError(ctxErr, err error) error {
+	if pqErr, ok := err.(*Error); ok && ctxErr != nil && pqErr.Code == "57014" {
+		return ctxErr
+	}
+	return err
+}
+
+// Cancel asks the server to cancel the statement the connection is running,
+// if any.  The request is sent over a new connection to the same server, made
+// with the Dialer and SSL settings of the connection.  If the server cancels
+// the statement, the statement fails with a query_canceled error.
+//
+// Unlike the other methods of the connection, Cancel may be called from any
+// goroutine while the connection is in use.  Through database/sql, use the
+// Canceler method instead; see the package documentation.
+func (cn *conn) Cancel() error {
+	return cn.Canceler().Cancel()
+}
+
+// Canceler returns a Canceler for the statements of the connection.  It can
+// be called in a sql.Conn.Raw callback, unlike Cancel, since the Canceler
+// does not refer to the connection itself.
+func (cn *conn) Canceler() *Canceler {
+	return &Canceler{
+		processID: cn.processID,
+		secretKey: cn.secretKey,
+		opts:      cn.opts.Copy(),
+		cfg:       cn.cfg,
+	}
+}
+
+// Canceler holds what is needed to cancel the statements of a connection:
+// the process ID and secret key the server sent when the connection was
+// made, and the settings to reach the server with.  It may be used from any
+// goroutine, for as long as the connection is open.
+type Canceler struct {
+	processID int
+	secretKey int
+	opts      values
+	cfg       *Config
+}
+
+// Cancel asks the server to cancel the statement the connection is running,
+// if any, like the Cancel method of the connection.
+func (c *Canceler) Cancel() error {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	return c.cancel(ctx)
+}
+
+// cancel asks the server to cancel the statement cn is running.
+func (cn *conn) cancel(ctx context.Context) error {
+	return cn.Canceler().cancel(ctx)
+}
+
+// cancel sends the CancelRequest over a new connection to the server, made
+// with the same settings as the connection to cancel.
+func (c *Canceler) cancel(ctx context.Context) (err error) {
+	if c.processID == 0 && c.secretKey == 0 {
+		return errors.New("pq: the server did not send a cancellation key")
+	}
+	o := c.opts.Copy()
+	nc, err := dial(c.cfg.dialer(), o)
+	if err != nil {
+		return err
+	}
+	canceled := watchConnect(ctx, nc)
+	defer func() {
+		if canceled() {
+			err = ctx.Err()
+		}
+		nc.Close()
+	}()
+	defer errRecoverNoErrBadConn(&err)
+
+	can := &conn{c: nc}
+	can.ssl(ctx, o, c.cfg)
+
+	w := can.writeBuf(0)
+	w.int32(80877102) // cancel request code
+	w.int32(c.processID)
+	w.int32(c.secretKey)
+	can.sendStartupPacket(w)
+
+	// The server closes the connection once it has processed the request.
+	// There is no response, so there's nothing to check.
+	io.Copy(ioutil.Discard, can.c)
+	return nil
+}
@@ -0,0 +1,515 @@
+//go:build go1.8
+// +build go1.8
+
+package pq
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lib/pq/oid"
+)
+
+// cancelServer returns a fake server which answers "SELECT 1" right away, and
+// runs the "slow" statements until they are canceled.  The keys of the
+// CancelRequests are sent to cancels.
+func cancelServer(cancels chan<- [2]int) func(b *fakeBackend) {
+	canceled := make(chan struct{}, 1)
+	return func(b *fakeBackend) {
+		if b.startup() == nil {
+			if _, ok := b.c.(*tls.Conn); !ok && b.tlsConfig != nil {
+				panic("CancelRequest sent without SSL")
+			}
+			cancels <- b.cancelKey
+			canceled <- struct{}{}
+			return
+		}
+		b.sendAuth(AuthOk, nil)
+		b.sendBackendKeyData(4711, 1234)
+		b.sendReady()
+		b.serveQueries(nil, func(q string) string {
+			switch q {
+			case "SELECT 1":
+				return b.sendSelect(oid.T_int4, "1")
+			case "slow", "slow rows":
+				if q == "slow rows" {
+					b.sendRowDescription(oid.T_int4)
+					b.sendDataRow("1")
+				}
+				<-canceled
+				b.sendError("ERROR", "57014", "canceling statement due to user request")
+				return ""
+			}
+			panic(fmt.Sprintf("unexpected query %q", q))
+		}, nil)
+	}
+}
+
+func TestExecContextCancel(t *testing.T) {
+	cancels := make(chan [2]int, 1)
+	d := fakeDialer{t: t, handler: cancelServer(cancels)}
+	cn, err := dialOpen(d, "user=u sslmode=disable", &Driver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+	c := cn.(*conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.ExecContext(ctx, "slow", nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if key := <-cancels; key != [2]int{4711, 1234} {
+		t.Fatalf("unexpected cancel key %v", key)
+	}
+
+	// The connection must still be usable.
+	if _, err := c.ExecContext(context.Background(), "SELECT 1", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ExecContext(ctx, "SELECT 1", nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestQueryContextCancel(t *testing.T) {
+	cancels := make(chan [2]int, 1)
+	d := fakeDialer{t: t, handler: cancelServer(cancels)}
+	cn, err := dialOpen(d, "user=u sslmode=disable", &Driver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+	c := cn.(*conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rows, err := c.QueryContext(ctx, "slow rows", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil {
+		t.Fatal(err)
+	}
+	// The rest of the result is only sent once the query is canceled.
+	cancel()
+	if err := rows.Next(dest); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-cancels
+
+	rows, err = c.QueryContext(context.Background(), "SELECT 1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rows.Next(dest); err != nil || dest[0] != int64(1) {
+		t.Fatalf("unexpected result %v, %v", dest[0], err)
+	}
+	rows.Close()
+}
+
+func TestCancel(t *testing.T) {
+	cancels := make(chan [2]int, 1)
+	d := fakeDialer{t: t, handler: cancelServer(cancels), tlsConfig: fakeTLSConfig(t)}
+	cn, err := dialOpen(d, "user=u sslmode=require", &Driver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+	c := cn.(*conn)
+
+	result := make(chan error)
+	go func() {
+		_, err := c.Exec("slow", nil)
+		result <- err
+	}()
+	if err := c.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if key := <-cancels; key != [2]int{4711, 1234} {
+		t.Fatalf("unexpected cancel key %v", key)
+	}
+	if err := <-result; err == nil || err.(*Error).Code.Name() != "query_canceled" {
+		t.Fatalf("expected query_canceled, got %v", err)
+	}
+	if _, err := c.Exec("SELECT 1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A Canceler works the same, without referring to the connection.
+	canceler := c.Canceler()
+	go func() {
+		_, err := c.Exec("slow", nil)
+		result <- err
+	}()
+	if err := canceler.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if key := <-cancels; key != [2]int{4711, 1234} {
+		t.Fatalf("unexpected cancel key %v", key)
+	}
+	if err := <-result; err == nil || err.(*Error).Code.Name() != "query_canceled" {
+		t.Fatalf("expected query_canceled, got %v", err)
+	}
+
+	if err := (&conn{}).Cancel(); err == nil {
+		t.Fatal("expected an error without a cancellation key")
+	}
+}
+
+func TestNamedParameters(t *testing.T) {
+	cn := &conn{}
+	_, err := cn.QueryContext(context.Background(), "SELECT $1", []driver.NamedValue{{Name: "x", Ordinal: 1, Value: 1}})
+	if err == nil {
+		t.Fatal("expected an error for a named parameter")
+	}
+}
+
+func TestTransactionModes(t *testing.T) {
+	deferrable := WithTxOptions(context.Background(), TxOptions{Deferrable: true})
+	tests := []struct {
+		ctx   context.Context
+		level sql.IsolationLevel
+		ro    bool
+		mode  string
+	}{
+		{context.Background(), sql.LevelDefault, false, ""},
+		{context.Background(), sql.LevelDefault, true, " READ ONLY"},
+		{context.Background(), sql.LevelReadUncommitted, false, " ISOLATION LEVEL READ UNCOMMITTED"},
+		{context.Background(), sql.LevelReadCommitted, false, " ISOLATION LEVEL READ COMMITTED"},
+		{context.Background(), sql.LevelRepeatableRead, true, " ISOLATION LEVEL REPEATABLE READ READ ONLY"},
+		{context.Background(), sql.LevelSerializable, false, " ISOLATION LEVEL SERIALIZABLE"},
+		{deferrable, sql.LevelSerializable, true, " ISOLATION LEVEL SERIALIZABLE READ ONLY DEFERRABLE"},
+		{deferrable, sql.LevelDefault, false, " DEFERRABLE"},
+	}
+	for _, tt := range tests {
+		mode, err := transactionModes(tt.ctx, driver.TxOptions{Isolation: driver.IsolationLevel(tt.level), ReadOnly: tt.ro})
+		if err != nil {
+			t.Errorf("%v: %v", tt.level, err)
+		} else if mode != tt.mode {
+			t.Errorf("%v: got %q, want %q", tt.level, mode, tt.mode)
+		}
+	}
+
+	for _, level := range []sql.IsolationLevel{sql.LevelWriteCommitted, sql.LevelSnapshot, sql.LevelLinearizable} {
+		_, err := transactionModes(context.Background(), driver.TxOptions{Isolation: driver.IsolationLevel(level)})
+		if err == nil {
+			t.Errorf("%v: expected an error", level)
+		}
+	}
+}
+
+func TestBeginTx(t *testing.T) {
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		b.startup()
+		b.sendAuth(AuthOk, nil)
+		b.sendReady()
+		if q := b.expect('Q').string(); q != "BEGIN ISOLATION LEVEL SERIALIZABLE READ ONLY DEFERRABLE" {
+			panic(fmt.Sprintf("unexpected query %q", q))
+		}
+		w := &writeBuf{}
+		w.string("BEGIN")
+		b.send('C', w.buf)
+		b.send('Z', []byte{'T'})
+		b.expect('X')
+	}}
+	cn, err := dialOpen(d, "user=u sslmode=disable", &Driver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	ctx := WithTxOptions(context.Background(), TxOptions{Deferrable: true})
+	opts := driver.TxOptions{Isolation: driver.IsolationLevel(sql.LevelSerializable), ReadOnly: true}
+	if _, err := cn.(*conn).BeginTx(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNextResultSet(t *testing.T) {
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		b.accept()
+		b.serveQueries(nil, func(q string) string {
+			switch q {
+			case "multi":
+				b.sendCommandComplete(b.sendSelect(oid.T_int4, "1", "2"))
+				b.sendCommandComplete("INSERT 0 1")
+				b.sendCommandComplete(b.sendSelect(oid.T_text))
+				return b.sendSelect(oid.T_int8, "5", "6")
+			case "empty first":
+				b.sendCommandComplete(b.sendSelect(oid.T_text))
+				return b.sendSelect(oid.T_int4, "7")
+			}
+			return b.sendSelect(oid.T_int4, "1")
+		}, nil)
+	}}
+	cn, err := dialOpen(d, "user=u sslmode=disable", &Driver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+	c := cn.(*conn)
+
+	// next checks the next result of r.Next.
+	dest := make([]driver.Value, 1)
+	next := func(rs driver.Rows, want driver.Value) {
+		err := rs.Next(dest)
+		if want == io.EOF {
+			if err != io.EOF {
+				t.Fatalf("expected io.EOF, got %v, %v", dest[0], err)
+			}
+		} else if err != nil || dest[0] != want {
+			t.Fatalf("expected %v, got %v, %v", want, dest[0], err)
+		}
+	}
+
+	rs, err := c.Query("multi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rs.(*rows)
+	next(r, int64(1))
+	next(r, int64(2))
+	next(r, io.EOF)
+	if !r.HasNextResultSet() {
+		t.Fatal("expected another result set")
+	}
+	// The INSERT doesn't have a result set.
+	if err := r.NextResultSet(); err != nil {
+		t.Fatal(err)
+	}
+	if r.colTyps[0] != oid.T_text {
+		t.Errorf("expected a text column, got %v", r.colTyps[0])
+	}
+	next(r, io.EOF)
+	if err := r.NextResultSet(); err != nil {
+		t.Fatal(err)
+	}
+	next(r, int64(5))
+	// The remaining rows are skipped.
+	if err := r.NextResultSet(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if r.HasNextResultSet() {
+		t.Error("expected no more result sets")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A result set without rows is not skipped.
+	rs, err = c.Query("empty first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next(rs, io.EOF)
+	if err := rs.(*rows).NextResultSet(); err != nil {
+		t.Fatal(err)
+	}
+	next(rs, int64(7))
+	rs.Close()
+
+	// Closing the rows early skips the remaining result sets.
+	rs, err = c.Query("multi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next(rs, int64(1))
+	if err := rs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rs, err = c.Query("SELECT 1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next(rs, int64(1))
+	rs.Close()
+}
+
+// fetchServer returns a fake server for queries fetching their rows in
+// chunks.  Every query returns the five rows 1 to 5, and BEGIN, COMMIT and
+// any other simple query succeed.  The Execute and Close messages received,
+// and the simple queries, are sent to events.
+func fetchServer(events chan<- string) func(b *fakeBackend) {
+	return func(b *fakeBackend) {
+		b.accept()
+		portals := make(map[string]int)
+		binary := make(map[string]bool)
+		b.serveQueries(events, func(q string) string {
+			switch q {
+			case "rows":
+				return b.sendSelect(oid.T_int4, "1", "2", "3", "4", "5")
+			case "BEGIN":
+				b.txnStatus = 'T'
+			case "COMMIT":
+				b.txnStatus = 'I'
+			}
+			return q
+		}, func(t byte, r *readBuf) {
+			switch t {
+			case 'P':
+				b.send('1', nil)
+			case 'D':
+				b.send('t', []byte{0, 0})
+				b.sendRowDescription(oid.T_int4)
+			case 'B':
+				portal := r.string()
+				r.string()
+				r.next(2 * r.int16())
+				for n := r.int16(); n > 0; n-- {
+					r.next(r.int32())
+				}
+				binary[portal] = r.int16() > 0 && r.int16() == 1
+				portals[portal] = 0
+				b.send('2', nil)
+			case 'E':
+				portal := r.string()
+				max := r.int32()
+				events <- fmt.Sprintf("Execute %s %d", portal, max)
+				n, ok := portals[portal]
+				if !ok {
+					b.sendError("ERROR", "34000", "portal does not exist")
+					return
+				}
+				for n < 5 && (max == 0 || n < portals[portal]+max) {
+					n++
+					if binary[portal] {
+						w := &writeBuf{}
+						w.int16(1)
+						w.int32(4)
+						w.int32(n)
+						b.send('D', w.buf)
+					} else {
+						b.sendDataRow(fmt.Sprint(n))
+					}
+				}
+				if n < 5 {
+					b.send('s', nil)
+				} else {
+					b.sendCommandComplete(fmt.Sprintf("SELECT %d", n-portals[portal]))
+				}
+				portals[portal] = n
+			case 'C':
+				r.byte()
+				portal := r.string()
+				events <- "Close " + portal
+				delete(portals, portal)
+				b.send('3', nil)
+			case 'S':
+				if b.txnStatus != 'T' {
+					portals = make(map[string]int)
+				}
+				b.sendReady()
+			default:
+				panic(fmt.Sprintf("unexpected message %q", t))
+			}
+		})
+	}
+}
+
+func TestFetchSize(t *testing.T) {
+	events := make(chan string, 100)
+	d := fakeDialer{t: t, handler: fetchServer(events)}
+	cn, err := dialOpen(d, "user=u sslmode=disable fetch_size=2", &Driver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+	c := cn.(*conn)
+
+	dest := make([]driver.Value, 1)
+	readRows := func(rows driver.Rows, n int) []driver.Value {
+		var got []driver.Value
+		for i := 0; i < n; i++ {
+			if err := rows.Next(dest); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, dest[0])
+		}
+		return got
+	}
+	received := func() []string {
+		var got []string
+		for len(events) > 0 {
+			got = append(got, <-events)
+		}
+		return got
+	}
+	check := func(got, want interface{}) {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	// Outside of a transaction, all rows are fetched at once.
+	rows, err := c.Query("rows", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(readRows(rows, 10), []driver.Value{int64(1), int64(2), int64(3), int64(4), int64(5)})
+	rows.Close()
+	check(received(), []string{"rows"})
+
+	tx, err := c.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err = c.Query("rows", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(readRows(rows, 3), []driver.Value{int64(1), int64(2), int64(3)})
+	// Other statements can run in between chunks.
+	if _, err := c.Exec("other", nil); err != nil {
+		t.Fatal(err)
+	}
+	check(readRows(rows, 10), []driver.Value{int64(4), int64(5)})
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(received(), []string{"BEGIN", "Execute p1 2", "Execute p1 2", "other", "Execute p1 2", "Close p1"})
+
+	// Including before the first one is read.
+	rows, err = c.Query("rows", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Exec("other", nil); err != nil {
+		t.Fatal(err)
+	}
+	check(readRows(rows, 10), []driver.Value{int64(1), int64(2), int64(3), int64(4), int64(5)})
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(received(), []string{"Execute p2 2", "other", "Execute p2 2", "Execute p2 2", "Close p2"})
+
+	// The fetch size can be set for each query, and the portal is closed
+	// if the rows are closed early.
+	rows, err = c.QueryContext(WithFetchSize(context.Background(), 3), "rows", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(readRows(rows, 1), []driver.Value{int64(1)})
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	check(received(), []string{"Execute p3 3", "Close p3", "COMMIT"})
+}
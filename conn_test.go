@@ -1,15 +1,20 @@
 package pq
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/lib/pq/oid"
 )
 
 type Fatalistic interface {
@@ -609,6 +614,286 @@ func TestErrorDuringStartup(t *testing.T) {
 	}
 }
 
+// fakeServer returns a fakeBackend handler for a server with the given
+// version, which is either in hot standby mode or not.  Servers since
+// Postgres 14 report their state in ParameterStatus messages; older ones only
+// answer queries about it.
+func fakeServer(version string, standby bool) func(b *fakeBackend) {
+	return func(b *fakeBackend) {
+		onOff, tf := "off", "f"
+		if standby {
+			onOff, tf = "on", "t"
+		}
+		b.startup()
+		b.sendAuth(AuthOk, nil)
+		b.sendParameterStatus("server_version", version)
+		if !strings.HasPrefix(version, "9.") {
+			b.sendParameterStatus("in_hot_standby", onOff)
+			b.sendParameterStatus("default_transaction_read_only", onOff)
+		}
+		b.sendReady()
+		b.serveQueries(nil, func(q string) string {
+			switch q {
+			case "SHOW transaction_read_only":
+				return b.sendSelect(oid.T_text, onOff)
+			case "SELECT pg_catalog.pg_is_in_recovery()":
+				return b.sendSelect(oid.T_bool, tf)
+			}
+			panic(fmt.Sprintf("unexpected query %q", q))
+		}, nil)
+	}
+}
+
+func TestMultiHost(t *testing.T) {
+	d := fakeDialer{t: t, hosts: map[string]func(b *fakeBackend){
+		"down:5433": func(b *fakeBackend) {
+			b.startup()
+			b.sendError("FATAL", "57P03", "the database system is starting up")
+		},
+		"up:5434": fakeServer("14.0.1", false),
+	}}
+
+	cn, err := DialOpen(d, "host=unknown,down,up port=5432,5433,5434 sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.Close()
+
+	_, err = DialOpen(d, "host=unknown,down port=5432,5433 sslmode=disable")
+	if pgErr, ok := err.(*Error); !ok || pgErr.Code != "57P03" {
+		t.Fatalf("expected the error from the last host, got %v", err)
+	}
+
+	_, err = DialOpen(d, "host=a,b,c port=5432,5433 sslmode=disable")
+	if err == nil || err.Error() != "could not match 2 port numbers to 3 hosts" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestTargetSessionAttrs(t *testing.T) {
+	d := fakeDialer{t: t, hosts: map[string]func(b *fakeBackend){
+		"primary14:5432": fakeServer("14.0.1", false),
+		"standby14:5432": fakeServer("14.0.2", true),
+		"primary96:5432": fakeServer("9.6.1", false),
+		"standby96:5432": fakeServer("9.6.2", true),
+	}}
+
+	tests := []struct {
+		hosts   string
+		attrs   string
+		version int
+		err     string
+	}{
+		{"standby14,primary14", "", 140002, ""},
+		{"standby14,primary14", "any", 140002, ""},
+		{"standby14,primary14", "read-write", 140001, ""},
+		{"primary14,standby14", "read-only", 140002, ""},
+		{"standby14,primary14", "primary", 140001, ""},
+		{"primary14,standby14", "standby", 140002, ""},
+		{"primary14,standby14", "prefer-standby", 140002, ""},
+		{"primary14,primary96", "prefer-standby", 140001, ""},
+		{"standby96,primary96", "read-write", 90601, ""},
+		{"primary96,standby96", "read-only", 90602, ""},
+		{"standby96,primary96", "primary", 90601, ""},
+		{"primary96,standby96", "standby", 90602, ""},
+		{"primary14,primary96", "standby", 0, "pq: server is not in hot standby mode"},
+		{"standby14,standby96", "read-write", 0, "pq: session is read-only"},
+		{"primary14", "master", 0, "unsupported target_session_attrs"},
+	}
+
+	for _, tt := range tests {
+		name := fmt.Sprintf("host=%s target_session_attrs='%s' sslmode=disable", tt.hosts, tt.attrs)
+		cn, err := DialOpen(d, name)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%s: expected error %q, got %v", name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if v := cn.(*conn).parameterStatus.serverVersion; v != tt.version {
+			t.Errorf("%s: connected to server version %d, expected %d", name, v, tt.version)
+		}
+		cn.Close()
+	}
+}
+
+func TestParseServerVersion(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		want    int
+	}{
+		{"9.6.24", 90624},
+		{"9.6beta1", 90600},
+		{"14.5", 140005},
+		{"14.5 (Debian 14.5-1.pgdg110+1)", 140005},
+		{"16devel", 160000},
+		{"unknown", 0},
+	} {
+		if got := parseServerVersion(tt.version); got != tt.want {
+			t.Errorf("%q: got %d, want %d", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestLoadBalanceHosts(t *testing.T) {
+	defer func(f func(context.Context, string) ([]string, error)) { lookupHost = f }(lookupHost)
+	var lookupDeadline time.Time
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookupDeadline, _ = ctx.Deadline()
+		if host != "replicas" {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		return []string{"10.0.0.1", "10.0.0.2"}, nil
+	}
+	d := fakeDialer{t: t, hosts: map[string]func(b *fakeBackend){
+		"10.0.0.1:5432": fakeServer("14.0.1", true),
+		"10.0.0.2:5432": fakeServer("14.0.2", true),
+		"10.0.0.3:5432": fakeServer("14.0.3", true),
+	}}
+	passwordFunc := func(ctx context.Context, host, port, user, dbname string) (string, error) {
+		if host != "replicas" && host != "replica3" {
+			t.Errorf("expected the host name, got %q", host)
+		}
+		return "", nil
+	}
+
+	const name = "host=replicas,replica3 hostaddr=,10.0.0.3 sslmode=disable"
+	seen := make(map[int]int)
+	for i := 0; i < 60; i++ {
+		cn, err := dialOpen(d, name+" load_balance_hosts=random", &Driver{PasswordFunc: passwordFunc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[cn.(*conn).parameterStatus.serverVersion]++
+		cn.Close()
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected connections to all three servers, got %v", seen)
+	}
+
+	// The lookup is bounded by connect_timeout.
+	start := time.Now()
+	cn, err := dialOpen(d, name+" load_balance_hosts=random connect_timeout=5", &Driver{PasswordFunc: passwordFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.Close()
+	if lookupDeadline.Before(start) || lookupDeadline.After(time.Now().Add(5*time.Second)) {
+		t.Fatalf("expected the lookup to be bounded by connect_timeout, got deadline %v", lookupDeadline)
+	}
+
+	// Without load balancing, the name is dialed as is, which the fake
+	// dialer refuses.
+	for i := 0; i < 5; i++ {
+		cn, err := dialOpen(d, name+" load_balance_hosts=disable", &Driver{PasswordFunc: passwordFunc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := cn.(*conn).parameterStatus.serverVersion; v != 140003 {
+			t.Fatalf("expected to connect to replica3, got server version %d", v)
+		}
+		cn.Close()
+	}
+
+	_, err = DialOpen(d, name+" load_balance_hosts=roundrobin")
+	if err == nil || !strings.HasPrefix(err.Error(), "unsupported load_balance_hosts") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestServiceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pqgotest_service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	userFile := filepath.Join(dir, "user_service.conf")
+	err = ioutil.WriteFile(userFile, []byte(`
+# services for the tests
+[reporting]
+dbname = reports
+user=reporter
+application_name=from service file
+
+[nested]
+service=reporting
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "pg_service.conf"), []byte(`
+[reporting]
+dbname=ignored
+
+[system]
+dbname=systemdb
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, env := range []string{"PGSERVICE", "PGSERVICEFILE", "PGSYSCONFDIR", "PGAPPNAME", "PGUSER", "PGSSLMODE"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Unsetenv("PGSERVICE")
+	os.Setenv("PGSERVICEFILE", userFile)
+	os.Setenv("PGSYSCONFDIR", dir)
+	os.Setenv("PGAPPNAME", "from environment")
+	os.Setenv("PGUSER", "envuser")
+	os.Setenv("PGSSLMODE", "disable")
+
+	var params map[string]string
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		params = b.startup()
+		b.sendAuth(AuthOk, nil)
+		b.sendReady()
+	}}
+
+	tests := []struct {
+		name     string
+		env      string
+		expected map[string]string
+		err      string
+	}{
+		{"service=reporting", "", map[string]string{"database": "reports", "user": "reporter", "application_name": "from service file"}, ""},
+		{"service=reporting user=explicit", "", map[string]string{"database": "reports", "user": "explicit", "application_name": "from service file"}, ""},
+		{"postgres://explicit@/?service=reporting", "", map[string]string{"database": "reports", "user": "explicit", "application_name": "from service file"}, ""},
+		{"user=explicit", "reporting", map[string]string{"database": "reports", "user": "explicit", "application_name": "from service file"}, ""},
+		{"service=system", "", map[string]string{"database": "systemdb", "user": "envuser", "application_name": "from environment"}, ""},
+		{"service=missing", "", nil, `pq: definition of service "missing" not found`},
+		{"service=nested", "", nil, "pq: nested service specifications not supported"},
+	}
+
+	for _, tt := range tests {
+		os.Setenv("PGSERVICE", tt.env)
+		params = nil
+		cn, err := DialOpen(d, tt.name)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%s: expected error %q, got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		cn.Close()
+		for k, v := range tt.expected {
+			if params[k] != v {
+				t.Errorf("%s: expected %s=%q, got %q", tt.name, k, v, params[k])
+			}
+		}
+		if _, ok := params["service"]; ok {
+			t.Errorf("%s: service sent to the server", tt.name)
+		}
+	}
+}
+
 func TestBadConn(t *testing.T) {
 	var err error
 
@@ -1082,6 +1367,10 @@ var envParseTests = []struct {
 		Env:      []string{"PGCONNECT_TIMEOUT=30"},
 		Expected: map[string]string{"connect_timeout": "30"},
 	},
+	{
+		Env:      []string{"PGTARGETSESSIONATTRS=read-write"},
+		Expected: map[string]string{"target_session_attrs": "read-write"},
+	},
 }
 
 func TestParseEnviron(t *testing.T) {
@@ -0,0 +1,54 @@
+//go:build go1.10
+// +build go1.10
+
+package pq
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+// Connector establishes connections as configured by a Config.  It
+// implements driver.Connector, and can be used with sql.OpenDB.
+type Connector struct {
+	cfg Config
+}
+
+// NewConnector returns a Connector for cfg.  The configuration is checked and
+// copied; changing cfg afterwards does not affect the Connector.
+//
+// Unlike with Open, settings which are not set in cfg are not taken from the
+// environment.  Use ParseConfig to get those.  The one exception is the
+// password file, which is still consulted if cfg has no password; see
+// Config.Password.
+func NewConnector(cfg *Config) (*Connector, error) {
+	c := &Connector{cfg: *cfg}
+	c.cfg.Hosts = append([]Host(nil), cfg.Hosts...)
+	c.cfg.RuntimeParams = make(map[string]string, len(cfg.RuntimeParams))
+	for k, v := range cfg.RuntimeParams {
+		c.cfg.RuntimeParams[k] = v
+	}
+	if _, err := c.cfg.values(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Connect establishes a new connection.  If ctx is done before the connection
+// has been established, the attempt is abandoned.
+func (c *Connector) Connect(ctx context.Context) (driver.Conn, error) {
+	cn, err := c.cfg.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cn, nil
+}
+
+// Driver returns a Driver with the PasswordFunc and SSLPasswordFunc of the
+// Connector's configuration.
+func (c *Connector) Driver() driver.Driver {
+	return &Driver{
+		PasswordFunc:    c.cfg.PasswordFunc,
+		SSLPasswordFunc: c.cfg.SSLPasswordFunc,
+	}
+}
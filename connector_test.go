@@ -0,0 +1,196 @@
+//go:build go1.10
+// +build go1.10
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lib/pq/oid"
+)
+
+func TestConnector(t *testing.T) {
+	params := make(chan map[string]string, 1)
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		params <- b.startup()
+		b.sendAuth(AuthOk, nil)
+		b.sendReady()
+		b.expect('X')
+	}}
+	c, err := NewConnector(&Config{
+		Hosts:         []Host{{Host: "db", Port: 6432}},
+		User:          "o'brien",
+		Database:      "my db",
+		SSLMode:       "disable",
+		Dialer:        d,
+		RuntimeParams: map[string]string{"application_name": `it's a \ test`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(c)
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	p := <-params
+	for k, v := range map[string]string{
+		"user":             "o'brien",
+		"database":         "my db",
+		"application_name": `it's a \ test`,
+		"client_encoding":  "UTF8",
+	} {
+		if p[k] != v {
+			t.Errorf("startup parameter %q: got %q, want %q", k, p[k], v)
+		}
+	}
+	if _, ok := p["sslmode"]; ok {
+		t.Error("sslmode sent as a run-time parameter")
+	}
+}
+
+func TestConnectorContext(t *testing.T) {
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		b.startup()
+		// never answer
+		time.Sleep(time.Second)
+	}}
+	c, err := NewConnector(&Config{User: "u", SSLMode: "disable", Dialer: d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.Connect(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestNewConnectorError(t *testing.T) {
+	_, err := NewConnector(&Config{User: "u", SSLMode: "disable", TargetSessionAttrs: "replica"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestNoticeHandler(t *testing.T) {
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		b.startup()
+		b.sendAuth(AuthOk, nil)
+		b.sendNotice("hello")
+		b.sendReady()
+		b.serveQueries(nil, func(q string) string {
+			b.sendNotice(q)
+			return b.sendSelect(oid.T_int4, "1")
+		}, nil)
+	}}
+	var notices []string
+	c, err := NewConnector(&Config{
+		User:    "u",
+		SSLMode: "disable",
+		Dialer:  d,
+		NoticeHandler: func(err *Error) {
+			notices = append(notices, string(err.Severity)+": "+err.Message)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := c.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	cn := dc.(*conn)
+
+	query := func(q string) {
+		rows, err := cn.Query(q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+	}
+	query("first")
+	var session []*Error
+	cn.SetNoticeHandler(func(err *Error) { session = append(session, err) })
+	query("second")
+	cn.SetNoticeHandler(nil)
+	query("third")
+
+	want := []string{"NOTICE: hello", "NOTICE: first"}
+	if !reflect.DeepEqual(notices, want) {
+		t.Errorf("got notices %q, want %q", notices, want)
+	}
+	if len(session) != 1 || session[0].Message != "second" || session[0].Code != "00000" {
+		t.Errorf("unexpected session notices %v", session)
+	}
+}
+
+func TestParameterStatus(t *testing.T) {
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		b.startup()
+		b.sendAuth(AuthOk, nil)
+		b.sendParameterStatus("server_version", "14.5 (Debian 14.5-1.pgdg110+1)")
+		b.sendParameterStatus("is_superuser", "on")
+		b.sendParameterStatus("application_name", "")
+		b.sendReady()
+		b.serveQueries(nil, func(q string) string {
+			// Unchanged values are reported again sometimes.
+			b.sendParameterStatus("is_superuser", "on")
+			b.sendParameterStatus("application_name", q)
+			return b.sendSelect(oid.T_int4, "1")
+		}, nil)
+	}}
+	var changes []string
+	c, err := NewConnector(&Config{
+		User:    "u",
+		SSLMode: "disable",
+		Dialer:  d,
+		ParameterStatusHandler: func(name, value string) {
+			changes = append(changes, name+"="+value)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := c.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	cn := dc.(*conn)
+
+	if v := cn.ServerVersion(); v != 140005 {
+		t.Errorf("expected server version 140005, got %d", v)
+	}
+	if v, ok := cn.ParameterStatus("is_superuser"); v != "on" || !ok {
+		t.Errorf("is_superuser: got %q, %v", v, ok)
+	}
+	if v, ok := cn.ParameterStatus("in_hot_standby"); v != "" || ok {
+		t.Errorf("in_hot_standby: got %q, %v", v, ok)
+	}
+
+	rows, err := cn.Query("SET application_name = 'app'", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	want := []string{"application_name=SET application_name = 'app'"}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got changes %q, want %q", changes, want)
+	}
+	params := cn.ParameterStatuses()
+	params["is_superuser"] = "off"
+	if v, _ := cn.ParameterStatus("is_superuser"); v != "on" {
+		t.Errorf("ParameterStatuses did not return a copy")
+	}
+	if len(params) != 3 || params["application_name"] != "SET application_name = 'app'" {
+		t.Errorf("unexpected parameters %v", params)
+	}
+}
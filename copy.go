@@ -151,7 +151,7 @@ func (ci *copyin) resploop() {
 		case 'C':
 			// complete
 		case 'N':
-			// NoticeResponse
+			ci.cn.processNotice(&r)
 		case 'Z':
 			ci.cn.processReadyForQuery(&r)
 			ci.done <- true
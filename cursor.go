@@ -0,0 +1,131 @@
+//go:build go1.10
+// +build go1.10
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+)
+
+// Querier runs statements on a single connection to the server, as *sql.Tx
+// and *sql.Conn do.  Cursors are declared on a Querier.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// CursorOptions are the options of a cursor declared with DeclareCursor.
+type CursorOptions struct {
+	// Scroll allows fetching and moving backward.  Otherwise the cursor is
+	// declared NO SCROLL.
+	Scroll bool
+
+	// WithHold makes the cursor outlive the transaction which declared it,
+	// if the transaction commits.  The rows are then copied when the
+	// transaction commits, so the cursor must be closed explicitly, lest it
+	// last until the end of the session.
+	WithHold bool
+}
+
+// Cursor is a server-side cursor, from which the rows of a query are
+// fetched a few at a time.
+type Cursor struct {
+	q    Querier
+	name string
+}
+
+// DeclareCursor declares a cursor named name for query on q.  Parameters are
+// passed as $1, $2, etc. in query, as with Exec and Query.  Unless opts has
+// WithHold set, q must be a *sql.Tx, or a *sql.Conn with a transaction
+// running, and the cursor is closed at the end of the transaction.  A nil
+// opts declares a NO SCROLL cursor without hold.
+func DeclareCursor(ctx context.Context, q Querier, name string, opts *CursorOptions, query string, args ...interface{}) (*Cursor, error) {
+	if opts == nil {
+		opts = &CursorOptions{}
+	}
+	stmt := "DECLARE " + QuoteIdentifier(name)
+	if opts.Scroll {
+		stmt += " SCROLL"
+	} else {
+		stmt += " NO SCROLL"
+	}
+	stmt += " CURSOR"
+	if opts.WithHold {
+		stmt += " WITH HOLD"
+	}
+	stmt += " FOR " + query
+	if _, err := q.ExecContext(ctx, stmt, args...); err != nil {
+		return nil, err
+	}
+	return &Cursor{q: q, name: name}, nil
+}
+
+// Name returns the name of the cursor.
+func (c *Cursor) Name() string {
+	return c.name
+}
+
+// Fetch fetches the next n rows of the cursor, or if n is negative, the
+// previous -n rows, in reverse order.  Fewer rows are returned at the end of
+// the cursor.  The rows must be closed before the cursor is used again.
+func (c *Cursor) Fetch(ctx context.Context, n int) (*sql.Rows, error) {
+	return c.q.QueryContext(ctx, "FETCH "+direction(n)+" FROM "+QuoteIdentifier(c.name))
+}
+
+// Move moves the cursor like Fetch does, but without returning the rows.
+// It returns the number of rows it moved over.
+func (c *Cursor) Move(ctx context.Context, n int) (int64, error) {
+	res, err := c.q.ExecContext(ctx, "MOVE "+direction(n)+" IN "+QuoteIdentifier(c.name))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ForEach fetches the remaining rows of the cursor, n at a time, and calls fn
+// for each of them.  If fn returns an error, ForEach stops and returns it.
+// fn may scan the row it is called for from rows, but must not advance or
+// close rows.
+func (c *Cursor) ForEach(ctx context.Context, n int, fn func(rows *sql.Rows) error) error {
+	if n <= 0 {
+		return errors.New("pq: ForEach needs a positive number of rows to fetch at a time")
+	}
+	for {
+		rows, err := c.Fetch(ctx, n)
+		if err != nil {
+			return err
+		}
+		fetched := 0
+		for rows.Next() {
+			fetched++
+			if err := fn(rows); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if fetched < n {
+			return nil
+		}
+	}
+}
+
+// Close closes the cursor.
+func (c *Cursor) Close(ctx context.Context) error {
+	_, err := c.q.ExecContext(ctx, "CLOSE "+QuoteIdentifier(c.name))
+	return err
+}
+
+// direction returns the direction clause of FETCH and MOVE for n rows.
+func direction(n int) string {
+	if n < 0 {
+		return "BACKWARD " + strconv.Itoa(-n)
+	}
+	return "FORWARD " + strconv.Itoa(n)
+}
@@ -0,0 +1,150 @@
+//go:build go1.10
+// +build go1.10
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq/oid"
+)
+
+// cursorServer returns a fake server with a single cursor over the rows 1
+// to 5, which supports FETCH and MOVE in either direction.  All statements
+// are sent to queries.
+func cursorServer(queries chan<- string) func(b *fakeBackend) {
+	return func(b *fakeBackend) {
+		b.accept()
+		// The position of the cursor: 0 is before the first row, 6 after
+		// the last.
+		pos := 0
+		b.serveQueries(queries, func(q string) string {
+			switch words := strings.Fields(q); words[0] {
+			case "DECLARE":
+				return "DECLARE CURSOR"
+			case "CLOSE":
+				return "CLOSE CURSOR"
+			case "FETCH", "MOVE":
+				n, _ := strconv.Atoi(words[2])
+				var rows []int
+				for ; n > 0; n-- {
+					if words[1] == "FORWARD" && pos < 5 {
+						pos++
+					} else if words[1] == "BACKWARD" && pos > 1 {
+						pos--
+					} else {
+						if words[1] == "FORWARD" {
+							pos = 6
+						} else {
+							pos = 0
+						}
+						break
+					}
+					rows = append(rows, pos)
+				}
+				if words[0] == "FETCH" {
+					b.sendRowDescription(oid.T_int4)
+					for _, v := range rows {
+						b.sendDataRow(strconv.Itoa(v))
+					}
+				}
+				return fmt.Sprintf("%s %d", words[0], len(rows))
+			}
+			panic(fmt.Sprintf("unexpected statement %q", q))
+		}, nil)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	queries := make(chan string, 100)
+	connector, err := NewConnector(&Config{
+		User:    "u",
+		SSLMode: "disable",
+		Dialer:  fakeDialer{t: t, handler: cursorServer(queries)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	ctx := context.Background()
+	c, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cur, err := DeclareCursor(ctx, c, "my cursor", &CursorOptions{Scroll: true, WithHold: true}, "SELECT generate_series(1, 5)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(n int) []int {
+		rows, err := cur.Fetch(ctx, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var got []int
+		for rows.Next() {
+			var v int
+			if err := rows.Scan(&v); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, v)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	if got := fetch(2); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("fetched %v, want [1 2]", got)
+	}
+	if n, err := cur.Move(ctx, 2); err != nil || n != 2 {
+		t.Errorf("moved %d, %v, want 2", n, err)
+	}
+	if got := fetch(-2); !reflect.DeepEqual(got, []int{3, 2}) {
+		t.Errorf("fetched %v, want [3 2]", got)
+	}
+
+	var got []int
+	err = cur.ForEach(ctx, 2, func(rows *sql.Rows) error {
+		var v int
+		err := rows.Scan(&v)
+		got = append(got, v)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []int{3, 4, 5}) {
+		t.Errorf("ForEach got %v, want [3 4 5]", got)
+	}
+	if err := cur.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	close(queries)
+	var stmts []string
+	for q := range queries {
+		stmts = append(stmts, q)
+	}
+	want := []string{
+		`DECLARE "my cursor" SCROLL CURSOR WITH HOLD FOR SELECT generate_series(1, 5)`,
+		`FETCH FORWARD 2 FROM "my cursor"`,
+		`MOVE FORWARD 2 IN "my cursor"`,
+		`FETCH BACKWARD 2 FROM "my cursor"`,
+		`FETCH FORWARD 2 FROM "my cursor"`,
+		`FETCH FORWARD 2 FROM "my cursor"`,
+		`CLOSE "my cursor"`,
+	}
+	if !reflect.DeepEqual(stmts, want) {
+		t.Errorf("got statements\n%q\nwant\n%q", stmts, want)
+	}
+}
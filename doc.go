@@ -41,24 +41,72 @@ For compatibility with libpq, the following special connection parameters are
 supported:
 
 	* dbname - The name of the database to connect to
+	* service - The name of a service in the connection service file to take parameters from
 	* user - The user to sign in as
 	* password - The user's password
 	* host - The host to connect to. Values that start with / are for unix domain sockets. (default is localhost)
+	* hostaddr - The numeric IP address to connect to instead of looking up host. host is still used for SSL verification and the password file.
 	* port - The port to bind to. (default is 5432)
+	* target_session_attrs - The kind of server to accept when several hosts are given (default is any)
+	* load_balance_hosts - Set to random to try the hosts, and all addresses their names resolve to, in random order (default is disable)
 	* sslmode - Whether or not to use SSL (default is require, this is not the default for libpq)
 	* fallback_application_name - An application_name to fall back to if one isn't provided.
 	* connect_timeout - Maximum wait for connection, in seconds. Zero or not specified means wait indefinitely.
-	* sslcert - Cert file location. The file must contain PEM encoded data.
+	* sslcert - Cert file location. The file must contain PEM encoded data, or be a PKCS#12 file with a .p12 or .pfx extension which contains both the certificate and the key.
 	* sslkey - Key file location. The file must contain PEM encoded data.
+	* sslpassword - The password to decrypt the key with, if it is encrypted.
 	* sslrootcert - The location of the root certificate file. The file must contain PEM encoded data.
+	* sslcrl - The location of a certificate revocation list file. The file may contain PEM or DER encoded data.
+	* sslcrldir - The location of a directory containing certificate revocation list files.
+	* channel_binding - Whether to use SCRAM channel binding with the SSL connection (default is prefer)
+	* fetch_size - The number of rows queries in a transaction fetch at a time (default is 0, all rows at once)
+
+Encrypted keys may be in the traditional OpenSSL format, or encrypted PKCS#8
+keys.  Instead of setting sslpassword, the password can also be supplied by
+setting Driver.SSLPasswordFunc.
 
 Valid values for sslmode are:
 
 	* disable - No SSL
+	* allow - First try without SSL; if the server rejects that, try again with SSL (skip verification)
+	* prefer - Use SSL if the server supports it, and try again without SSL if the server rejects the SSL connection (skip verification)
 	* require - Always SSL (skip verification)
 	* verify-ca - Always SSL (verify that the certificate presented by the server was signed by a trusted CA)
 	* verify-full - Always SSL (verify that the certification presented by the server was signed by a trusted CA and the server host name matches the one in the certificate)
 
+With verify-ca and verify-full, the certificates presented by the server are
+also checked against the certificate revocation lists in sslcrl and sslcrldir,
+if any.  Every certificate in the chain except the root must then be covered
+by a current CRL from its issuer.
+
+Valid values for channel_binding are:
+
+	* disable - Never use channel binding
+	* prefer - Use channel binding if the connection uses SSL and the server supports SCRAM-SHA-256-PLUS
+	* require - Refuse to connect unless the server authenticates using SCRAM-SHA-256-PLUS over SSL
+
+Channel binding ties SCRAM authentication to the server certificate presented
+in the SSL handshake (tls-server-end-point), so that a man-in-the-middle
+cannot relay the authentication exchange.  Only require protects against an
+attacker downgrading the connection to another authentication method.
+
+Valid values for target_session_attrs are:
+
+	* any - Any server
+	* read-write - A server whose sessions accept write transactions by default
+	* read-only - A server whose sessions are read-only by default
+	* primary - A server which is not in hot standby mode
+	* standby - A server in hot standby mode
+	* prefer-standby - A server in hot standby mode if there is one, any server otherwise
+
+Both host and port accept comma-separated lists, e.g.
+"host=db1,db2 port=5432,5433".  The hosts are tried in order until a
+connection which satisfies target_session_attrs is established, each with
+its own connect_timeout.  A single port applies to all hosts.  With
+load_balance_hosts=random, the order is shuffled for every new connection,
+which spreads the connections of a pool over all hosts.  URLs may list
+several hosts as well: "postgres://db1:5432,db2:5433/mydb".
+
 See http://www.postgresql.org/docs/current/static/libpq-connect.html#LIBPQ-CONNSTRING
 for more information about connection string parameters.
 
@@ -89,6 +137,42 @@ provided connection parameters.
 The pgpass mechanism as described in http://www.postgresql.org/docs/current/static/libpq-pgpass.html
 is supported, but on Windows PGPASSFILE must be specified explicitly.
 
+The connection service file as described in http://www.postgresql.org/docs/current/static/libpq-pgservice.html
+is supported.  The settings of the service selected with the service parameter
+or PGSERVICE are read from the file named by PGSERVICEFILE or from
+~/.pg_service.conf, or else from pg_service.conf in PGSYSCONFDIR.  They
+override environment variables, but not explicitly provided connection
+parameters.
+
+Passwords which change over time, such as access tokens, can be supplied by
+setting Driver.PasswordFunc and registering the driver under a name of your
+choice:
+
+	sql.Register("postgres-token", &pq.Driver{PasswordFunc: fetchToken})
+	db, err := sql.Open("postgres-token", "host=db.example.com user=app")
+
+pq supports the cleartext, MD5 and SCRAM-SHA-256 authentication methods.
+Other methods, or SASL mechanisms, can be plugged in by implementing the
+Authenticator interface and registering it with RegisterAuthenticator or
+RegisterSASLMechanism.
+
+Instead of a connection string, the connection settings can be given as a
+Config, which avoids quoting and escaping and allows setting a custom
+tls.Config or Dialer.  ParseConfig turns a connection string into a Config,
+and NewConnector makes a connector for sql.OpenDB (Go 1.10 and later):
+
+	cfg, err := pq.ParseConfig("host=db.example.com dbname=app")
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.RuntimeParams["application_name"] = name
+	cfg.TLSConfig = tlsConfig
+	connector, err := pq.NewConnector(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+
 Queries
 
 database/sql does not dictate any specific format for parameter
@@ -112,8 +196,120 @@ For more details on RETURNING, see the Postgres documentation:
 	http://www.postgresql.org/docs/current/static/sql-update.html
 	http://www.postgresql.org/docs/current/static/sql-delete.html
 
+A query without parameters may consist of several statements separated by
+semicolons.  The rows of each statement which returns rows form a result set
+of their own, which is reached with Rows.NextResultSet (Go 1.8 and later):
+
+	rows, err := db.Query("SELECT id FROM users; SELECT id, title FROM posts")
+	...
+	for rows.Next() { ... }
+	if rows.NextResultSet() {
+		for rows.Next() { ... }
+	}
+
+In a transaction, the rows of a query can be fetched a chunk at a time, rather
+than all at once, by setting the fetch_size connection parameter, or for a
+single query with WithFetchSize:
+
+	rows, err := tx.QueryContext(pq.WithFetchSize(ctx, 1000), "SELECT * FROM events")
+
+Between chunks, other statements can be run in the transaction.  Outside of a
+transaction, all rows are still fetched at once.
+
+Server-side cursors are declared with DeclareCursor on a *sql.Tx, or on a
+*sql.Conn for cursors WITH HOLD.  Cursor.Fetch and Cursor.Move then move
+through the rows in either direction, and Cursor.ForEach calls a function for
+each of the remaining rows:
+
+	cur, err := pq.DeclareCursor(ctx, tx, "events", nil, "SELECT id, payload FROM events")
+	...
+	err = cur.ForEach(ctx, 1000, func(rows *sql.Rows) error {
+		return rows.Scan(&id, &payload)
+	})
+
 For additional instructions on querying see the documentation for the database/sql package.
 
+If the context passed to QueryContext, ExecContext or the like is canceled or
+times out while the statement is running, pq asks the server to cancel it by
+sending a CancelRequest over a separate connection.  The statement then fails
+with the context's error, and the connection remains usable.
+
+A statement can also be canceled from another goroutine with a Canceler,
+which sends the same CancelRequest using the connection's Dialer and SSL
+settings.  Get it from the driver connection through sql.Conn.Raw before
+running the statement; unlike the driver connection, the Canceler may be kept
+after the callback returns, and used while the connection is in use:
+
+	var canceler *pq.Canceler
+	err := conn.Raw(func(driverConn interface{}) error {
+		canceler = driverConn.(interface{ Canceler() *pq.Canceler }).Canceler()
+		return nil
+	})
+	...
+	go func() {
+		<-abort
+		canceler.Cancel()
+	}()
+	_, err = conn.ExecContext(ctx, "REINDEX TABLE big_table")
+
+BeginTx supports all isolation levels of Postgres (read uncommitted, read
+committed, repeatable read and serializable) as well as read-only
+transactions.  Other isolation levels are rejected with an error.
+Transactions can be made DEFERRABLE with WithTxOptions:
+
+	ctx = pq.WithTxOptions(ctx, pq.TxOptions{Deferrable: true})
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true})
+
+Savepoints are available for transactions begun on a sql.Conn (Go 1.13 and
+later).  RunInSavepoint runs a function as a sub-transaction, whose failure
+leaves the enclosing transaction usable:
+
+	err = pq.RunInSavepoint(ctx, conn, "import_row", func() error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO items VALUES ($1)", item)
+		return err
+	})
+
+Savepoint, ReleaseSavepoint and RollbackToSavepoint give finer control.
+
+RunInTx runs a function in a transaction, and runs it again in a new
+transaction if the server aborts it with a serialization failure or because
+of a deadlock, as is necessary with SERIALIZABLE transactions:
+
+	err := pq.RunInTx(ctx, db, &sql.TxOptions{Isolation: sql.LevelSerializable}, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE accounts SET balance = balance - 100 WHERE id = $1", id)
+		return err
+	})
+
+For two-phase commit, PrepareTransaction prepares the transaction running on a
+sql.Conn under a global identifier.  CommitPrepared and RollbackPrepared then
+finish it from any connection, and PreparedTransactions lists the prepared
+transactions still waiting for either, e.g. when recovering from a crash of
+the transaction manager.  Prepared transactions must be enabled on the server
+with max_prepared_transactions.
+
+To save round trips, many statements can be sent to the server at once with
+SendBatch.  The results are returned in order, each with its own error:
+
+	b := &pq.Batch{}
+	for _, u := range users {
+		b.Queue("INSERT INTO users (name) VALUES ($1)", u)
+	}
+	results, err := pq.SendBatch(ctx, conn, b)
+
+By default a failed statement makes the server skip the rest of the batch;
+set SyncEach to run each statement regardless.  Unless binary_parameters is
+set, the statements with []byte parameters are described first, which takes
+one more round trip, since their encoding depends on the parameter types.
+
+SendAsync sends a single statement without waiting for its result, which is
+read later with the Wait method of the Future returned.  This allows sending
+several independent statements before reading any of the results:
+
+	f1, err := pq.SendAsync(ctx, conn, "UPDATE stats SET hits = hits + 1 WHERE page = $1", page)
+	f2, err := pq.SendAsync(ctx, conn, "SELECT count(*) FROM comments WHERE page = $1", page)
+	...
+	res, err := f2.Wait(ctx)
+
 Errors
 
 pq may return errors of type *pq.Error which can be interrogated for error details:
@@ -124,6 +320,21 @@ pq may return errors of type *pq.Error which can be interrogated for error detai
 
 See the pq.Error type for details.
 
+Notices, such as the output of RAISE NOTICE or VACUUM VERBOSE, are discarded
+unless a handler is set with Config.NoticeHandler, or for a single
+connection with its SetNoticeHandler method, reached through sql.Conn.Raw.
+The handler receives them as *pq.Error values:
+
+	cfg.NoticeHandler = func(notice *pq.Error) {
+		log.Printf("%s: %s", notice.Severity, notice.Message)
+	}
+
+The run-time parameters the server reports, such as server_version,
+standard_conforming_strings or is_superuser, are available through the
+ParameterStatus, ParameterStatuses and ServerVersion methods of a connection,
+reached through sql.Conn.Raw.  Config.ParameterStatusHandler is called when
+one of them changes during the session.
+
 
 Bulk imports
 
@@ -208,5 +419,20 @@ bytes by the PostgreSQL server.
 You can find a complete, working example of Listener usage at
 http://godoc.org/github.com/lib/pq/listen_example.
 
+Ordinary connections can receive notifications as well, if a handler is set
+with Config.NotificationHandler, or with the SetNotificationHandler method of
+the connection.  Notifications are then passed to the handler as they arrive
+with the results of statements, and WaitForNotification waits for them on a
+sql.Conn between statements:
+
+	_, err = conn.ExecContext(ctx, "LISTEN jobs")
+	...
+	for {
+		if err := pq.WaitForNotification(ctx, conn); err != nil {
+			return err
+		}
+		// run the jobs the handler was notified of
+	}
+
 */
 package pq
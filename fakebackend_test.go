@@ -0,0 +1,332 @@
+package pq
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lib/pq/oid"
+)
+
+// fakeDialer hands out loopback connections, each of which is served by a
+// fakeBackend running handler in its own goroutine.
+type fakeDialer struct {
+	t       *testing.T
+	handler func(b *fakeBackend)
+
+	// If set, SSLRequests are accepted using this configuration.
+	tlsConfig *tls.Config
+
+	// If set, the handler to use for each address, overriding handler.
+	// Connections to any other address are refused.
+	hosts map[string]func(b *fakeBackend)
+
+	// If set, dialing takes this long.
+	delay time.Duration
+}
+
+func (d fakeDialer) Dial(ntw, addr string) (net.Conn, error) {
+	time.Sleep(d.delay)
+	handler := d.handler
+	if d.hosts != nil {
+		handler = d.hosts[addr]
+		if handler == nil {
+			return nil, &net.OpError{Op: "dial", Net: ntw, Err: errors.New("connection refused")}
+		}
+	}
+
+	// Use a loopback connection rather than net.Pipe, so that writes are
+	// buffered like they are with a real server.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	go func() {
+		defer server.Close()
+		defer func() {
+			// The client hanging up early is not an error of the backend.
+			if p := recover(); p != nil && p != io.EOF {
+				if _, ok := p.(net.Error); !ok {
+					d.t.Errorf("fake backend: %v", p)
+				}
+			}
+		}()
+		b := &fakeBackend{c: server, buf: bufio.NewReader(server), tlsConfig: d.tlsConfig}
+		handler(b)
+		// Let the client say goodbye, unless it sent a CancelRequest; the
+		// server hangs up on those right away.
+		if b.cancelKey == [2]int{} {
+			io.Copy(ioutil.Discard, server)
+		}
+	}()
+	return client, nil
+}
+
+func (d fakeDialer) DialTimeout(ntw, addr string, timeout time.Duration) (net.Conn, error) {
+	return d.Dial(ntw, addr)
+}
+
+// fakeBackend speaks just enough of the server side of the protocol to test
+// connection establishment without a real server.  All methods panic on I/O
+// errors.
+type fakeBackend struct {
+	c         net.Conn
+	buf       *bufio.Reader
+	tlsConfig *tls.Config
+
+	// the process ID and secret key of a CancelRequest
+	cancelKey [2]int
+
+	// the transaction status sent by sendReady; idle if zero
+	txnStatus byte
+}
+
+// startup reads the startup packet and returns the parameters sent by the
+// client.  An SSLRequest is refused unless the backend has a TLS
+// configuration.  If the client sends a CancelRequest instead, the key is
+// stored in cancelKey and nil is returned.
+func (b *fakeBackend) startup() map[string]string {
+	for {
+		var x [4]byte
+		if _, err := io.ReadFull(b.buf, x[:]); err != nil {
+			panic(err)
+		}
+		r := readBuf(x[:])
+		msg := make(readBuf, r.int32()-4)
+		if _, err := io.ReadFull(b.buf, msg); err != nil {
+			panic(err)
+		}
+		if code := msg.int32(); code == 80877103 {
+			if b.tlsConfig == nil {
+				if _, err := b.c.Write([]byte{'N'}); err != nil {
+					panic(err)
+				}
+				continue
+			}
+			if _, err := b.c.Write([]byte{'S'}); err != nil {
+				panic(err)
+			}
+			b.c = tls.Server(b.c, b.tlsConfig)
+			b.buf = bufio.NewReader(b.c)
+			continue
+		} else if code == 80877102 {
+			b.cancelKey = [2]int{msg.int32(), msg.int32()}
+			return nil
+		} else if code != 196608 {
+			panic(fmt.Sprintf("unexpected protocol version %d", code))
+		}
+		params := make(map[string]string)
+		for {
+			k := msg.string()
+			if k == "" {
+				return params
+			}
+			params[k] = msg.string()
+		}
+	}
+}
+
+func (b *fakeBackend) recv() (byte, *readBuf) {
+	var x [5]byte
+	if _, err := io.ReadFull(b.buf, x[:]); err != nil {
+		panic(err)
+	}
+	r := readBuf(x[1:])
+	msg := make(readBuf, r.int32()-4)
+	if _, err := io.ReadFull(b.buf, msg); err != nil {
+		panic(err)
+	}
+	return x[0], &msg
+}
+
+// expect receives a message, and panics if it's not of type typ.
+func (b *fakeBackend) expect(typ byte) *readBuf {
+	t, r := b.recv()
+	if t != typ {
+		panic(fmt.Sprintf("expected message %q, got %q", typ, t))
+	}
+	return r
+}
+
+func (b *fakeBackend) send(typ byte, payload []byte) {
+	w := &writeBuf{buf: []byte{typ, 0, 0, 0, 0}, pos: 1}
+	w.bytes(payload)
+	if _, err := b.c.Write(w.wrap()); err != nil {
+		panic(err)
+	}
+}
+
+func (b *fakeBackend) sendAuth(code int, data []byte) {
+	w := &writeBuf{}
+	w.int32(code)
+	w.bytes(data)
+	b.send('R', w.buf)
+}
+
+func (b *fakeBackend) sendError(severity string, code ErrorCode, msg string) {
+	w := &writeBuf{}
+	w.byte('S')
+	w.string(severity)
+	w.byte('C')
+	w.string(string(code))
+	w.byte('M')
+	w.string(msg)
+	w.byte(0)
+	b.send('E', w.buf)
+}
+
+func (b *fakeBackend) sendNotice(msg string) {
+	w := &writeBuf{}
+	w.byte('S')
+	w.string("NOTICE")
+	w.byte('C')
+	w.string("00000")
+	w.byte('M')
+	w.string(msg)
+	w.byte(0)
+	b.send('N', w.buf)
+}
+
+func (b *fakeBackend) sendNotification(processID int, channel, payload string) {
+	w := &writeBuf{}
+	w.int32(processID)
+	w.string(channel)
+	w.string(payload)
+	b.send('A', w.buf)
+}
+
+func (b *fakeBackend) sendBackendKeyData(processID, secretKey int) {
+	w := &writeBuf{}
+	w.int32(processID)
+	w.int32(secretKey)
+	b.send('K', w.buf)
+}
+
+func (b *fakeBackend) sendReady() {
+	status := b.txnStatus
+	if status == 0 {
+		status = 'I'
+	}
+	b.send('Z', []byte{status})
+}
+
+func (b *fakeBackend) sendCommandComplete(tag string) {
+	w := &writeBuf{}
+	w.string(tag)
+	b.send('C', w.buf)
+}
+
+// accept completes the startup of a connection without authentication.
+func (b *fakeBackend) accept() {
+	b.startup()
+	b.sendAuth(AuthOk, nil)
+	b.sendReady()
+}
+
+// serve passes the messages received to handle, until the client terminates
+// the connection.
+func (b *fakeBackend) serve(handle func(t byte, r *readBuf)) {
+	for {
+		t, r := b.recv()
+		if t == 'X' {
+			return
+		}
+		handle(t, r)
+	}
+}
+
+// serveQueries answers the simple queries received, until the client
+// terminates the connection.  Each query is sent to queries, unless that is
+// nil, and passed to answer, which sends the rows or the error of the query,
+// if any, and returns the command tag to complete the query with, or "" after
+// an error.  ReadyForQuery follows.  Other messages are passed to other, or
+// cause a panic if other is nil.
+func (b *fakeBackend) serveQueries(queries chan<- string, answer func(q string) string, other func(t byte, r *readBuf)) {
+	b.serve(func(t byte, r *readBuf) {
+		if t != 'Q' {
+			if other == nil {
+				panic(fmt.Sprintf("unexpected message %q", t))
+			}
+			other(t, r)
+			return
+		}
+		q := r.string()
+		if queries != nil {
+			queries <- q
+		}
+		if tag := answer(q); tag != "" {
+			b.sendCommandComplete(tag)
+		}
+		b.sendReady()
+	})
+}
+
+func (b *fakeBackend) sendParameterStatus(name, value string) {
+	w := &writeBuf{}
+	w.string(name)
+	w.string(value)
+	b.send('S', w.buf)
+}
+
+// sendRows sends the result of a query returning a single column of type typ,
+// followed by ReadyForQuery.
+func (b *fakeBackend) sendRows(typ oid.Oid, values ...string) {
+	b.sendCommandComplete(b.sendSelect(typ, values...))
+	b.sendReady()
+}
+
+// sendSelect sends the rows of a query returning a single column of type
+// typ, and returns the command tag to complete the query with.
+func (b *fakeBackend) sendSelect(typ oid.Oid, values ...string) string {
+	b.sendRowDescription(typ)
+	for _, v := range values {
+		b.sendDataRow(v)
+	}
+	return fmt.Sprintf("SELECT %d", len(values))
+}
+
+// sendRowDescription describes a single column of type typ.
+func (b *fakeBackend) sendRowDescription(typ oid.Oid) {
+	w := &writeBuf{}
+	w.int16(1)
+	w.string("?column?")
+	w.int32(0)
+	w.int16(0)
+	w.int32(int(typ))
+	w.int16(-1)
+	w.int32(-1)
+	w.int16(0)
+	b.send('T', w.buf)
+}
+
+func (b *fakeBackend) sendDataRow(v string) {
+	w := &writeBuf{}
+	w.int16(1)
+	w.int32(len(v))
+	w.bytes([]byte(v))
+	b.send('D', w.buf)
+}
+
+func fakeTLSConfig(t *testing.T) *tls.Config {
+	cert, err := tls.LoadX509KeyPair("certs/server.crt", "certs/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
@@ -4,8 +4,11 @@ package pq
 // This module contains support for Postgres LISTEN/NOTIFY.
 
 import (
+	"context"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,6 +32,108 @@ func recvNotification(r *readBuf) *Notification {
 	return &Notification{bePid, channel, extra}
 }
 
+// processNotification passes a NotificationResponse to the notification
+// handler, if any.
+func (cn *conn) processNotification(r *readBuf) {
+	cn.notifications++
+	if h := cn.notificationHandler; h != nil {
+		h(recvNotification(r))
+	}
+}
+
+// SetNotificationHandler sets the function the notifications received on
+// this connection are passed to, or discards them if handler is nil.  This
+// overrides Config.NotificationHandler.  Like SetNoticeHandler, it is called
+// through sql.Conn.Raw with database/sql, and the handler remains set after
+// the sql.Conn is closed.
+//
+// Notifications are received along with the results of statements, and by
+// WaitForNotification between statements.
+func (cn *conn) SetNotificationHandler(handler func(*Notification)) {
+	cn.notificationHandler = handler
+}
+
+// waitForNotification receives messages from the server until one or more
+// notifications have been passed to the notification handler, or ctx is
+// done.  No statement may be running.
+func (cn *conn) waitForNotification(ctx context.Context) (err error) {
+	if cn.bad {
+		return driver.ErrBadConn
+	}
+	defer cn.errRecover(&err)
+
+	if cn.notificationHandler == nil {
+		return errors.New("pq: no notification handler is set")
+	}
+	if len(cn.pending) > 0 {
+		cn.readPending(len(cn.pending))
+	}
+	start := cn.notifications
+	for cn.notifications == start {
+		if err := cn.waitForInput(ctx); err != nil {
+			return err
+		}
+		var r readBuf
+		t, err := cn.recvMessage(&r)
+		if err != nil {
+			panic(err)
+		}
+		switch t {
+		case 'A':
+			cn.processNotification(&r)
+		case 'N':
+			cn.processNotice(&r)
+		case 'S':
+			cn.processParameterStatus(&r)
+		case 'E':
+			// The server is about to close the connection.
+			cn.bad = true
+			return parseError(&r)
+		default:
+			cn.bad = true
+			errorf("unexpected message %q while waiting for notifications", t)
+		}
+	}
+	return nil
+}
+
+// waitForInput blocks until a message from the server can be read, or ctx is
+// done, in which case ctx.Err() is returned.  Nothing is read, so that the
+// connection can be used normally afterwards either way.
+func (cn *conn) waitForInput(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cn.buf.Buffered() > 0 {
+		return nil
+	}
+	if ctx.Done() != nil {
+		// Interrupt the read below once ctx is done.
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				cn.c.SetReadDeadline(time.Now())
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+			cn.c.SetReadDeadline(time.Time{})
+		}()
+	}
+	if _, err := cn.buf.Peek(1); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		panic(err)
+	}
+	return nil
+}
+
 const (
 	connStateIdle int32 = iota
 	connStateExpectResponse
@@ -170,7 +275,9 @@ func (l *ListenerConn) listenerConnLoop() (err error) {
 			}
 			l.replyChan <- message{t, nil}
 
-		case 'N', 'S':
+		case 'N':
+			l.cn.processNotice(r)
+		case 'S':
 			// ignore
 		default:
 			return fmt.Errorf("unexpected message %q from server in listenerConnLoop", t)
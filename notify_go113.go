@@ -0,0 +1,26 @@
+//go:build go1.13
+// +build go1.13
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// WaitForNotification waits until a notification is received on c, and
+// passes it to the notification handler set with Config.NotificationHandler
+// or SetNotificationHandler.  It returns ctx.Err() if ctx is done first, and
+// c can then be used normally.  No transaction needs to be running; after
+// LISTEN, a worker can thus alternate between running statements on c and
+// waiting for notifications.
+func WaitForNotification(ctx context.Context, c *sql.Conn) error {
+	return c.Raw(func(driverConn interface{}) error {
+		cn, ok := driverConn.(*conn)
+		if !ok {
+			return errors.New("pq: not a pq connection")
+		}
+		return cn.waitForNotification(ctx)
+	})
+}
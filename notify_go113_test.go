@@ -0,0 +1,102 @@
+//go:build go1.13
+// +build go1.13
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestWaitForNotification(t *testing.T) {
+	d := fakeDialer{t: t, handler: func(b *fakeBackend) {
+		b.startup()
+		b.sendAuth(AuthOk, nil)
+		b.sendReady()
+		for {
+			t, r := b.recv()
+			if t == 'X' {
+				return
+			}
+			q := r.string()
+			// A notification received along with the result of a statement.
+			b.sendNotification(1, "jobs", "during "+q)
+			w := &writeBuf{}
+			w.string("LISTEN")
+			b.send('C', w.buf)
+			b.sendReady()
+			if q == "notify later" {
+				time.Sleep(10 * time.Millisecond)
+				b.sendNotification(2, "jobs", "later")
+			}
+		}
+	}}
+	notifications := make(chan *Notification, 10)
+	connector, err := NewConnector(&Config{
+		User:                "u",
+		SSLMode:             "disable",
+		Dialer:              d,
+		NotificationHandler: func(n *Notification) { notifications <- n },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	ctx := context.Background()
+	c, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	expect := func(want Notification) {
+		select {
+		case n := <-notifications:
+			if *n != want {
+				t.Errorf("got notification %+v, want %+v", *n, want)
+			}
+		default:
+			t.Errorf("expected notification %+v", want)
+		}
+	}
+
+	if _, err := c.ExecContext(ctx, "LISTEN jobs"); err != nil {
+		t.Fatal(err)
+	}
+	expect(Notification{1, "jobs", "during LISTEN jobs"})
+
+	// Waiting is interrupted by the context, and the connection remains
+	// usable.
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := WaitForNotification(tctx, c); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if _, err := c.ExecContext(ctx, "notify later"); err != nil {
+		t.Fatal(err)
+	}
+	expect(Notification{1, "jobs", "during notify later"})
+	if err := WaitForNotification(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	expect(Notification{2, "jobs", "later"})
+
+	// Without a handler, notifications would be lost.
+	c.Raw(func(driverConn interface{}) error {
+		driverConn.(*conn).SetNotificationHandler(nil)
+		return nil
+	})
+	if err := WaitForNotification(ctx, c); err == nil {
+		t.Fatal("expected an error without a handler")
+	}
+	if _, err := c.ExecContext(ctx, "LISTEN more"); err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) != 0 {
+		t.Errorf("unexpected notification %+v", <-notifications)
+	}
+}
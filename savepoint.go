@@ -0,0 +1,74 @@
+//go:build go1.13
+// +build go1.13
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// Savepoint creates a savepoint named name in the transaction running on c.
+// The transaction must have been begun with c.BeginTx, or with a BEGIN
+// statement on c.  Savepoints may be nested, and names may be reused; a name
+// then refers to the innermost savepoint of that name.
+func Savepoint(ctx context.Context, c *sql.Conn, name string) error {
+	return withConn(ctx, c, func(cn *conn) error {
+		return cn.savepoint(name)
+	})
+}
+
+// ReleaseSavepoint releases the savepoint named name in the transaction
+// running on c, and any savepoints created after it.  The changes made since
+// the savepoint was created are kept.
+func ReleaseSavepoint(ctx context.Context, c *sql.Conn, name string) error {
+	return withConn(ctx, c, func(cn *conn) error {
+		return cn.releaseSavepoint(name)
+	})
+}
+
+// RollbackToSavepoint undoes the changes made since the savepoint named name
+// was created in the transaction running on c, and releases any savepoints
+// created after it.  The savepoint itself remains.  If the transaction failed
+// after the savepoint was created, it can be used again afterwards.
+func RollbackToSavepoint(ctx context.Context, c *sql.Conn, name string) error {
+	return withConn(ctx, c, func(cn *conn) error {
+		return cn.rollbackToSavepoint(name)
+	})
+}
+
+// RunInSavepoint runs fn as a sub-transaction of the transaction running on
+// c.  If fn returns an error, the changes it made are rolled back, and the
+// transaction can be used again; the error is returned.  Otherwise, the
+// changes are kept.
+func RunInSavepoint(ctx context.Context, c *sql.Conn, name string, fn func() error) error {
+	if err := Savepoint(ctx, c, name); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		if rbErr := RollbackToSavepoint(ctx, c, name); rbErr != nil {
+			return rbErr
+		}
+		if relErr := ReleaseSavepoint(ctx, c, name); relErr != nil {
+			return relErr
+		}
+		return err
+	}
+	return ReleaseSavepoint(ctx, c, name)
+}
+
+// withConn runs f with the pq connection of c, canceling it if ctx is done.
+func withConn(ctx context.Context, c *sql.Conn, f func(cn *conn) error) error {
+	return c.Raw(func(driverConn interface{}) error {
+		cn, ok := driverConn.(*conn)
+		if !ok {
+			return errors.New("pq: not a pq connection")
+		}
+		finish, err := cn.watchCancel(ctx)
+		if err != nil {
+			return err
+		}
+		return canceledError(finish(), f(cn))
+	})
+}
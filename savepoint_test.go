@@ -0,0 +1,172 @@
+//go:build go1.13
+// +build go1.13
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// txServer returns a fake server which keeps track of the transaction status
+// for transaction control statements.  The statement "fail" fails with a
+// unique_violation, and "fail <code>" with the given error code.  After
+// "fail at commit <code>", which succeeds, COMMIT fails with the given error
+// code, like it does for serialization failures detected at commit time.
+// Preparing a transaction with the GID "fail" fails, and rolls it back.  Any
+// other statement succeeds as an INSERT.  All statements are sent to queries.
+func txServer(queries chan<- string) func(b *fakeBackend) {
+	return func(b *fakeBackend) {
+		b.accept()
+		var commitError ErrorCode
+		b.serveQueries(queries, func(q string) string {
+			switch {
+			case q == "BEGIN":
+				b.txnStatus = 'T'
+				return "BEGIN"
+			case q == "COMMIT" && b.txnStatus == 'E', q == "ROLLBACK":
+				b.txnStatus = 'I'
+				return "ROLLBACK"
+			case q == "COMMIT" && commitError != "":
+				b.sendError("ERROR", commitError, "could not serialize access")
+				b.txnStatus, commitError = 'I', ""
+				return ""
+			case q == "COMMIT":
+				b.txnStatus = 'I'
+				return "COMMIT"
+			case strings.HasPrefix(q, "ROLLBACK TO SAVEPOINT "):
+				b.txnStatus = 'T'
+				return "ROLLBACK"
+			case q == "PREPARE TRANSACTION 'fail'":
+				b.sendError("ERROR", "55000", "prepared transactions are disabled")
+				b.txnStatus = 'I'
+				return ""
+			case strings.HasPrefix(q, "PREPARE TRANSACTION "):
+				b.txnStatus = 'I'
+				return "PREPARE TRANSACTION"
+			case strings.HasPrefix(q, "COMMIT PREPARED "), strings.HasPrefix(q, "ROLLBACK PREPARED "):
+				return q[:strings.LastIndex(q, " ")]
+			case b.txnStatus == 'E':
+				b.sendError("ERROR", "25P02", "current transaction is aborted, commands ignored until end of transaction block")
+				return ""
+			case strings.HasPrefix(q, "SAVEPOINT "):
+				return "SAVEPOINT"
+			case strings.HasPrefix(q, "RELEASE SAVEPOINT "):
+				return "RELEASE"
+			case strings.HasPrefix(q, "fail at commit "):
+				commitError = ErrorCode(q[len("fail at commit "):])
+				return "INSERT 0 1"
+			case q == "fail", strings.HasPrefix(q, "fail "):
+				code := ErrorCode("23505")
+				if q != "fail" {
+					code = ErrorCode(q[len("fail "):])
+				}
+				b.sendError("ERROR", code, "failed")
+				if b.txnStatus == 'T' {
+					b.txnStatus = 'E'
+				}
+				return ""
+			}
+			return "INSERT 0 1"
+		}, nil)
+	}
+}
+
+func TestSavepoints(t *testing.T) {
+	queries := make(chan string, 100)
+	connector, err := NewConnector(&Config{
+		User:    "u",
+		SSLMode: "disable",
+		Dialer:  fakeDialer{t: t, handler: txServer(queries)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	ctx := context.Background()
+	c, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Savepoint(ctx, c, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("ok"); err != nil {
+		t.Fatal(err)
+	}
+	err = RunInSavepoint(ctx, c, "b", func() error {
+		_, err := tx.Exec("fail")
+		return err
+	})
+	if err == nil || err.(*Error).Code != "23505" {
+		t.Fatalf("expected the error of the sub-transaction, got %v", err)
+	}
+	// The failure of the sub-transaction must not affect the transaction.
+	if _, err := tx.Exec("ok"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReleaseSavepoint(ctx, c, "b"); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected an error for a released savepoint, got %v", err)
+	}
+	if err := ReleaseSavepoint(ctx, c, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failures in the transaction itself can be recovered from by rolling
+	// back to a savepoint.
+	if err := Savepoint(ctx, c, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("fail"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := Savepoint(ctx, c, "d"); err != ErrInFailedTransaction {
+		t.Fatalf("expected %v, got %v", ErrInFailedTransaction, err)
+	}
+	if err := RollbackToSavepoint(ctx, c, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	c.Raw(func(driverConn interface{}) error {
+		if sp := driverConn.(*conn).savepoints; sp != nil {
+			t.Errorf("savepoints left after commit: %v", sp)
+		}
+		return nil
+	})
+
+	close(queries)
+	var got []string
+	for q := range queries {
+		got = append(got, q)
+	}
+	want := []string{
+		`BEGIN`,
+		`SAVEPOINT "a"`,
+		`ok`,
+		`SAVEPOINT "b"`,
+		`fail`,
+		`ROLLBACK TO SAVEPOINT "b"`,
+		`RELEASE SAVEPOINT "b"`,
+		`ok`,
+		`RELEASE SAVEPOINT "a"`,
+		`SAVEPOINT "c"`,
+		`fail`,
+		`ROLLBACK TO SAVEPOINT "c"`,
+		`COMMIT`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got statements\n%q\nwant\n%q", got, want)
+	}
+}
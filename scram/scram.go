@@ -0,0 +1,268 @@
+// Package scram implements the client side of the Salted Challenge Response
+// Authentication Mechanism (SCRAM) as defined in RFC 5802 and RFC 7677.
+//
+// It is used by pq to authenticate with SCRAM-SHA-256, but does not depend on
+// anything Postgres-specific.
+package scram
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Client implements a SCRAM client.  A Client is good for a single
+// authentication exchange only.
+//
+// A typical exchange looks like:
+//
+//	client := scram.NewClient(sha256.New, user, password)
+//	var in []byte
+//	for client.Step(in) {
+//		// send client.Out() to the server, and read its reply into in
+//	}
+//	if client.Err() != nil {
+//		// authentication failed
+//	}
+type Client struct {
+	newHash func() hash.Hash
+
+	user string
+	pass string
+	step int
+	out  bytes.Buffer
+	err  error
+
+	// GS2 header and channel binding data; see SetChannelBinding
+	gs2Header string
+	cbData    []byte
+
+	clientNonce []byte
+	authMsg     bytes.Buffer
+	saltedPass  []byte
+}
+
+// NewClient returns a new SCRAM client using the hash function newHash, e.g.
+// sha256.New for SCRAM-SHA-256.  The user name and password are used as-is;
+// in particular, no SASLprep normalization is applied to the password.
+func NewClient(newHash func() hash.Hash, user, pass string) *Client {
+	c := &Client{
+		newHash:   newHash,
+		user:      user,
+		pass:      pass,
+		gs2Header: "n,,",
+	}
+	c.out.Grow(256)
+	c.authMsg.Grow(256)
+	return c
+}
+
+// Out returns the data to be sent to the server in the current step.
+func (c *Client) Out() []byte {
+	if c.out.Len() == 0 {
+		return nil
+	}
+	return c.out.Bytes()
+}
+
+// Err returns the error that occurred, or nil if there were no errors.
+func (c *Client) Err() error {
+	return c.err
+}
+
+// SetNonce sets the client nonce to the provided value.  If not set, the
+// nonce is generated automatically out of crypto/rand on the first step.
+// This is only useful for testing.
+func (c *Client) SetNonce(nonce []byte) {
+	c.clientNonce = nonce
+}
+
+// SetChannelBinding binds the exchange to the underlying secure channel.
+// cbType is the name of the channel binding type, e.g. "tls-server-end-point",
+// and data is the channel binding data of that type.  The server must have
+// selected a "-PLUS" mechanism for the binding to be accepted.
+//
+// It must be called before the first step.
+func (c *Client) SetChannelBinding(cbType string, data []byte) {
+	c.gs2Header = "p=" + cbType + ",,"
+	c.cbData = data
+}
+
+// SetChannelBindingSupported tells the server that the client supports
+// channel binding, but thinks the server does not.  A server which does
+// support channel binding will reject the exchange, which protects against an
+// attacker stripping the "-PLUS" mechanisms from the server's offer.
+//
+// It must be called before the first step.
+func (c *Client) SetChannelBindingSupported() {
+	c.gs2Header = "y,,"
+	c.cbData = nil
+}
+
+var escaper = strings.NewReplacer("=", "=3D", ",", "=2C")
+
+// Step processes the incoming data from the server and makes the next round
+// of data for the server available via Out.  Step returns true if there are
+// no errors and more data is still expected from the server.
+//
+// The first call to Step should be made with a nil argument.
+func (c *Client) Step(in []byte) bool {
+	c.out.Reset()
+	if c.step > 2 || c.err != nil {
+		return false
+	}
+	c.step++
+	switch c.step {
+	case 1:
+		c.err = c.step1(in)
+	case 2:
+		c.err = c.step2(in)
+	case 3:
+		c.err = c.step3(in)
+	}
+	return c.step < 3 && c.err == nil
+}
+
+func (c *Client) step1(in []byte) error {
+	if len(c.clientNonce) == 0 {
+		const nonceLen = 16
+		buf := make([]byte, nonceLen+base64.StdEncoding.EncodedLen(nonceLen))
+		if _, err := rand.Read(buf[:nonceLen]); err != nil {
+			return fmt.Errorf("cannot read random SCRAM nonce from operating system: %v", err)
+		}
+		c.clientNonce = buf[nonceLen:]
+		base64.StdEncoding.Encode(c.clientNonce, buf[:nonceLen])
+	}
+	c.authMsg.WriteString("n=")
+	escaper.WriteString(&c.authMsg, c.user)
+	c.authMsg.WriteString(",r=")
+	c.authMsg.Write(c.clientNonce)
+
+	c.out.WriteString(c.gs2Header)
+	c.out.Write(c.authMsg.Bytes())
+	return nil
+}
+
+var b64 = base64.StdEncoding
+
+func (c *Client) step2(in []byte) error {
+	c.authMsg.WriteByte(',')
+	c.authMsg.Write(in)
+
+	fields := bytes.Split(in, []byte(","))
+	if len(fields) != 3 {
+		return fmt.Errorf("expected 3 fields in first SCRAM server message, got %d: %q", len(fields), in)
+	}
+	if !bytes.HasPrefix(fields[0], []byte("r=")) || len(fields[0]) < 3 {
+		return fmt.Errorf("server sent an invalid SCRAM nonce: %q", fields[0])
+	}
+	if !bytes.HasPrefix(fields[1], []byte("s=")) || len(fields[1]) < 3 {
+		return fmt.Errorf("server sent an invalid SCRAM salt: %q", fields[1])
+	}
+	if !bytes.HasPrefix(fields[2], []byte("i=")) || len(fields[2]) < 3 {
+		return fmt.Errorf("server sent an invalid SCRAM iteration count: %q", fields[2])
+	}
+
+	nonce := fields[0][2:]
+	if !bytes.HasPrefix(nonce, c.clientNonce) {
+		return fmt.Errorf("server SCRAM nonce is not prefixed by client nonce: got %q, want %q+\"...\"", nonce, c.clientNonce)
+	}
+
+	salt := make([]byte, b64.DecodedLen(len(fields[1][2:])))
+	n, err := b64.Decode(salt, fields[1][2:])
+	if err != nil {
+		return fmt.Errorf("cannot decode SCRAM salt sent by server: %q", fields[1])
+	}
+	salt = salt[:n]
+	iterCount, err := strconv.Atoi(string(fields[2][2:]))
+	if err != nil || iterCount < 1 {
+		return fmt.Errorf("server sent an invalid SCRAM iteration count: %q", fields[2])
+	}
+	c.saltPassword(salt, iterCount)
+
+	cbind := b64.EncodeToString(append([]byte(c.gs2Header), c.cbData...))
+	c.authMsg.WriteString(",c=" + cbind + ",r=")
+	c.authMsg.Write(nonce)
+
+	c.out.WriteString("c=" + cbind + ",r=")
+	c.out.Write(nonce)
+	c.out.WriteString(",p=")
+	c.out.Write(c.clientProof())
+	return nil
+}
+
+func (c *Client) step3(in []byte) error {
+	var isv, ise bool
+	fields := bytes.Split(in, []byte(","))
+	if len(fields) == 1 {
+		isv = bytes.HasPrefix(fields[0], []byte("v="))
+		ise = bytes.HasPrefix(fields[0], []byte("e="))
+	}
+	if ise {
+		return fmt.Errorf("SCRAM authentication error: %s", fields[0][2:])
+	} else if !isv {
+		return fmt.Errorf("unsupported SCRAM final message from server: %q", in)
+	}
+	if !hmac.Equal(c.serverSignature(), fields[0][2:]) {
+		return errors.New("cannot authenticate SCRAM server signature")
+	}
+	return nil
+}
+
+// saltPassword computes Hi() as defined in RFC 5802, which is PBKDF2 with
+// HMAC as the pseudorandom function and an output length of one block.
+func (c *Client) saltPassword(salt []byte, iterCount int) {
+	mac := hmac.New(c.newHash, []byte(c.pass))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	ui := mac.Sum(nil)
+	hi := make([]byte, len(ui))
+	copy(hi, ui)
+	for i := 1; i < iterCount; i++ {
+		mac.Reset()
+		mac.Write(ui)
+		mac.Sum(ui[:0])
+		for j, b := range ui {
+			hi[j] ^= b
+		}
+	}
+	c.saltedPass = hi
+}
+
+func (c *Client) clientProof() []byte {
+	mac := hmac.New(c.newHash, c.saltedPass)
+	mac.Write([]byte("Client Key"))
+	clientKey := mac.Sum(nil)
+	hash := c.newHash()
+	hash.Write(clientKey)
+	storedKey := hash.Sum(nil)
+	mac = hmac.New(c.newHash, storedKey)
+	mac.Write(c.authMsg.Bytes())
+	clientProof := mac.Sum(nil)
+	for i, b := range clientKey {
+		clientProof[i] ^= b
+	}
+	clientProof64 := make([]byte, b64.EncodedLen(len(clientProof)))
+	b64.Encode(clientProof64, clientProof)
+	return clientProof64
+}
+
+func (c *Client) serverSignature() []byte {
+	mac := hmac.New(c.newHash, c.saltedPass)
+	mac.Write([]byte("Server Key"))
+	serverKey := mac.Sum(nil)
+
+	mac = hmac.New(c.newHash, serverKey)
+	mac.Write(c.authMsg.Bytes())
+	serverSignature := mac.Sum(nil)
+
+	encoded := make([]byte, b64.EncodedLen(len(serverSignature)))
+	b64.Encode(encoded, serverSignature)
+	return encoded
+}
@@ -0,0 +1,150 @@
+package scram
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+// The example exchange from RFC 7677, section 3.
+var rfc7677 = struct {
+	user, pass, nonce                                  string
+	clientFirst, serverFirst, clientFinal, serverFinal string
+}{
+	user:        "user",
+	pass:        "pencil",
+	nonce:       "rOprNGfwEbeRWgbNEkqO",
+	clientFirst: "n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+	serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+	clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+	serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+}
+
+func TestClientRFC7677(t *testing.T) {
+	v := rfc7677
+	c := NewClient(sha256.New, v.user, v.pass)
+	c.SetNonce([]byte(v.nonce))
+
+	if !c.Step(nil) {
+		t.Fatalf("step 1 failed: %v", c.Err())
+	}
+	if got := string(c.Out()); got != v.clientFirst {
+		t.Fatalf("client-first-message: got %q, want %q", got, v.clientFirst)
+	}
+	if !c.Step([]byte(v.serverFirst)) {
+		t.Fatalf("step 2 failed: %v", c.Err())
+	}
+	if got := string(c.Out()); got != v.clientFinal {
+		t.Fatalf("client-final-message: got %q, want %q", got, v.clientFinal)
+	}
+	if c.Step([]byte(v.serverFinal)) {
+		t.Fatal("expected the exchange to be complete after step 3")
+	}
+	if c.Err() != nil {
+		t.Fatal(c.Err())
+	}
+	if c.Out() != nil {
+		t.Fatalf("unexpected output after the final step: %q", c.Out())
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	v := rfc7677
+	tests := []struct {
+		serverFirst string
+		serverFinal string
+		err         string
+	}{
+		{
+			serverFirst: "r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			err:         "not prefixed by client nonce",
+		},
+		{
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqOabc,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+			err:         "invalid SCRAM iteration count",
+		},
+		{
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqOabc,s=W22ZaJ0SNY7soEsUEjb6gQ==",
+			err:         "expected 3 fields",
+		},
+		{
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqOabc,s=!!!!,i=4096",
+			err:         "cannot decode SCRAM salt",
+		},
+		{
+			serverFirst: v.serverFirst,
+			serverFinal: "v=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+			err:         "cannot authenticate SCRAM server signature",
+		},
+		{
+			serverFirst: v.serverFirst,
+			serverFinal: "e=invalid-proof",
+			err:         "SCRAM authentication error: invalid-proof",
+		},
+		{
+			serverFirst: v.serverFirst,
+			serverFinal: "x=what",
+			err:         "unsupported SCRAM final message",
+		},
+	}
+
+	for i, tt := range tests {
+		c := NewClient(sha256.New, v.user, v.pass)
+		c.SetNonce([]byte(v.nonce))
+		c.Step(nil)
+		if c.Step([]byte(tt.serverFirst)) {
+			c.Step([]byte(tt.serverFinal))
+		}
+		if c.Err() == nil {
+			t.Errorf("%d: expected an error", i)
+			continue
+		}
+		if !strings.Contains(c.Err().Error(), tt.err) {
+			t.Errorf("%d: expected error containing %q, got %q", i, tt.err, c.Err())
+		}
+		if c.Step(nil) {
+			t.Errorf("%d: Step should not continue after an error", i)
+		}
+	}
+}
+
+func TestClientChannelBinding(t *testing.T) {
+	v := rfc7677
+	tests := []struct {
+		setup       func(c *Client)
+		clientFirst string
+		cbind       string
+	}{
+		{
+			setup:       func(c *Client) {},
+			clientFirst: "n,,n=user,r=" + v.nonce,
+			cbind:       "c=biws,",
+		},
+		{
+			setup:       func(c *Client) { c.SetChannelBindingSupported() },
+			clientFirst: "y,,n=user,r=" + v.nonce,
+			cbind:       "c=eSws,",
+		},
+		{
+			setup:       func(c *Client) { c.SetChannelBinding("tls-server-end-point", []byte("\x00\x01\x02")) },
+			clientFirst: "p=tls-server-end-point,,n=user,r=" + v.nonce,
+			cbind:       "c=cD10bHMtc2VydmVyLWVuZC1wb2ludCwsAAEC,",
+		},
+	}
+
+	for i, tt := range tests {
+		c := NewClient(sha256.New, v.user, v.pass)
+		c.SetNonce([]byte(v.nonce))
+		tt.setup(c)
+		c.Step(nil)
+		if got := string(c.Out()); got != tt.clientFirst {
+			t.Errorf("%d: client-first-message: got %q, want %q", i, got, tt.clientFirst)
+		}
+		if !c.Step([]byte(v.serverFirst)) {
+			t.Fatalf("%d: step 2 failed: %v", i, c.Err())
+		}
+		if got := string(c.Out()); !strings.HasPrefix(got, tt.cbind) {
+			t.Errorf("%d: client-final-message: got %q, want prefix %q", i, got, tt.cbind)
+		}
+	}
+}
@@ -3,12 +3,16 @@ package pq
 // This file contains SSL tests
 
 import (
+	"context"
 	_ "crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -224,3 +228,229 @@ func TestSSLClientCertificatesMissingFiles(t *testing.T) {
 		t.Fatalf("expected ErrSSLKeyHasWorldPermissions, got %#+v", err)
 	}
 }
+
+func TestSSLModeAllowPrefer(t *testing.T) {
+	// hba returns a fakeBackend handler which only accepts connections with
+	// SSL, without SSL or both, like a pg_hba.conf with hostssl, hostnossl or
+	// host entries.
+	hba := func(ssl, nossl bool) func(b *fakeBackend) {
+		return func(b *fakeBackend) {
+			b.startup()
+			_, isTLS := b.c.(*tls.Conn)
+			if isTLS && !ssl || !isTLS && !nossl {
+				b.sendError("FATAL", "28000", "no pg_hba.conf entry")
+				return
+			}
+			b.sendAuth(AuthOk, nil)
+			b.sendReady()
+		}
+	}
+	tlsConfig := fakeTLSConfig(t)
+	// The client insists on TLS 1.2 or later, so handshakes fail with
+	// oldTLSConfig.
+	oldTLSConfig := tlsConfig.Clone()
+	oldTLSConfig.MinVersion = tls.VersionTLS10
+	oldTLSConfig.MaxVersion = tls.VersionTLS11
+	handshakeFails := func(b *fakeBackend) {
+		defer func() {
+			if _, isTLS := b.c.(*tls.Conn); isTLS {
+				recover()
+			}
+		}()
+		hba(true, true)(b)
+	}
+
+	tests := []struct {
+		sslmode   string
+		tlsConfig *tls.Config
+		handler   func(b *fakeBackend)
+		wantTLS   bool
+		err       string
+	}{
+		{"prefer", nil, hba(false, true), false, ""},
+		{"prefer", tlsConfig, hba(true, true), true, ""},
+		{"prefer", tlsConfig, hba(true, false), true, ""},
+		{"prefer", tlsConfig, hba(false, true), false, ""},
+		{"prefer", nil, hba(true, false), false, "no pg_hba.conf entry"},
+		{"prefer", oldTLSConfig, handshakeFails, false, ""},
+		{"require", oldTLSConfig, handshakeFails, false, "tls: "},
+		{"allow", nil, hba(false, true), false, ""},
+		{"allow", tlsConfig, hba(true, true), false, ""},
+		{"allow", tlsConfig, hba(true, false), true, ""},
+		{"allow", nil, hba(true, false), false, ErrSSLNotSupported.Error()},
+		{"require", nil, hba(false, true), false, ErrSSLNotSupported.Error()},
+		{"sometimes", nil, hba(true, true), false, "unsupported sslmode"},
+	}
+
+	for i, tt := range tests {
+		d := fakeDialer{t: t, tlsConfig: tt.tlsConfig, handler: tt.handler}
+		cn, err := DialOpen(d, "user=pqgotest sslmode="+tt.sslmode)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%d: expected error %q, got %v", i, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if _, isTLS := cn.(*conn).c.(*tls.Conn); isTLS != tt.wantTLS {
+			t.Errorf("%d: expected SSL to be used: %v, got %v", i, tt.wantTLS, isTLS)
+		}
+		cn.Close()
+	}
+}
+
+func TestSSLCRL(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("certs/crl/server.crt", "certs/crl/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := fakeDialer{t: t, tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}}, handler: func(b *fakeBackend) {
+		// The handshake fails when the client rejects the certificate.
+		defer func() { recover() }()
+		b.startup()
+		b.sendAuth(AuthOk, nil)
+		b.sendReady()
+	}}
+
+	crldir, err := ioutil.TempDir("", "pqgotest_crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(crldir)
+	revoked, err := ioutil.ReadFile("certs/crl/revoked.crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(crldir, "revoked.crl"), revoked, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Files other than CRLs are skipped.
+	if err := ioutil.WriteFile(filepath.Join(crldir, "README"), []byte("not a CRL\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		crl string
+		err string
+	}{
+		{"", ""},
+		{"sslcrl=certs/crl/valid.crl", ""},
+		{"sslcrl=certs/crl/revoked.crl", `pq: certificate "postgres" has been revoked`},
+		{"sslcrl=certs/crl/revoked.crl.der", `pq: certificate "postgres" has been revoked`},
+		{"sslcrl=certs/crl/expired.crl", `pq: CRL issued by "pq CRL test root" has expired`},
+		{"sslcrl=certs/crl/root.crt", "pq: couldn't parse CRL in certs/crl/root.crt"},
+		{"sslcrl=certs/crl/missing.crl", "no such file or directory"},
+		{"sslcrldir=" + crldir, `pq: certificate "postgres" has been revoked`},
+	}
+
+	for _, sslmode := range []string{"verify-ca", "verify-full"} {
+		for _, tt := range tests {
+			name := fmt.Sprintf("host=postgres user=pqgotest sslmode=%s sslrootcert=certs/crl/root.crt %s", sslmode, tt.crl)
+			cn, err := DialOpen(d, name)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+				} else {
+					cn.Close()
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error %q, got %v", name, tt.err, err)
+			}
+		}
+	}
+}
+
+func TestSSLClientKeyPassword(t *testing.T) {
+	// Key files must not be readable by others, which git does not preserve.
+	dir, err := ioutil.TempDir("", "pqgotest_sslkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{
+		"postgresql.crt",
+		"postgresql.key",
+		"postgresql-traditional.key",
+		"postgresql-pkcs8.key",
+		"postgresql-pkcs8-des3.key",
+		"postgresql-pkcs8-pbe.key",
+		"postgresql.p12",
+		"postgresql-legacy.p12",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join("certs", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tlsConfig := fakeTLSConfig(t)
+	tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	d := fakeDialer{t: t, tlsConfig: tlsConfig, handler: func(b *fakeBackend) {
+		b.startup()
+		certs := b.c.(*tls.Conn).ConnectionState().PeerCertificates
+		if len(certs) == 0 || certs[0].Subject.CommonName != "pqgosslcert" {
+			b.sendError("FATAL", "28000", "certificate authentication failed")
+			return
+		}
+		b.sendAuth(AuthOk, nil)
+		b.sendReady()
+	}}
+
+	var calls []string
+	drv := &Driver{SSLPasswordFunc: func(ctx context.Context, file string) (string, error) {
+		calls = append(calls, filepath.Base(file))
+		return "pqgotest", nil
+	}}
+
+	tests := []struct {
+		files    string
+		password string
+		err      string
+	}{
+		{"sslcert=postgresql.crt sslkey=postgresql.key", "", ""},
+		{"sslcert=postgresql.crt sslkey=postgresql-traditional.key", "pqgotest", ""},
+		{"sslcert=postgresql.crt sslkey=postgresql-pkcs8.key", "pqgotest", ""},
+		{"sslcert=postgresql.crt sslkey=postgresql-pkcs8-des3.key", "pqgotest", ""},
+		{"sslcert=postgresql.crt sslkey=postgresql-pkcs8-pbe.key", "pqgotest", ""},
+		{"sslcert=postgresql.p12", "pqgotest", ""},
+		{"sslcert=postgresql-legacy.p12", "pqgotest", ""},
+		{"sslcert=postgresql.crt sslkey=postgresql-traditional.key", "wrong", "incorrect password"},
+		{"sslcert=postgresql.crt sslkey=postgresql-pkcs8.key", "wrong", "incorrect password"},
+		{"sslcert=postgresql.crt sslkey=postgresql-pkcs8-pbe.key", "wrong", "incorrect password"},
+		{"sslcert=postgresql.p12", "wrong", "incorrect password"},
+		{"sslcert=postgresql.crt sslkey=postgresql-pkcs8.key", "", "no sslpassword was provided"},
+	}
+
+	for _, tt := range tests {
+		name := fmt.Sprintf("user=pqgotest sslmode=require %s sslpassword='%s'", tt.files, tt.password)
+		name = strings.Replace(name, "=postgresql", "="+dir+"/postgresql", -1)
+		cn, err := DialOpen(d, name)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.files, err)
+			} else {
+				cn.Close()
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected error %q, got %v", tt.files, tt.err, err)
+		}
+	}
+
+	for _, files := range []string{"sslcert=postgresql.crt sslkey=postgresql-pkcs8.key", "sslcert=postgresql.p12"} {
+		name := strings.Replace("user=pqgotest sslmode=require "+files, "=postgresql", "="+dir+"/postgresql", -1)
+		cn, err := dialOpen(d, name, drv)
+		if err != nil {
+			t.Fatalf("%s: %v", files, err)
+		}
+		cn.Close()
+	}
+	if fmt.Sprint(calls) != "[postgresql-pkcs8.key postgresql.p12]" {
+		t.Fatalf("unexpected calls to SSLPasswordFunc: %v", calls)
+	}
+}
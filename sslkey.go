@@ -0,0 +1,540 @@
+package pq
+
+// This file contains the code to load encrypted SSL client keys and PKCS#12
+// files.  Only the encryption schemes used by current versions of OpenSSL are
+// supported: PBES2 with PBKDF2 and AES or triple DES, and the PKCS#12 key
+// derivation with triple DES.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"unicode/utf16"
+)
+
+var errSSLKeyPassword = errors.New("incorrect password")
+
+var (
+	oidPBES2                   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1            = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA224          = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHMACWithSHA256          = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384          = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512          = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC              = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidPBEWithSHAAnd3KeyDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                    = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256                  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384                  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512                  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidPKCS7Data               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7EncryptedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidPKCS8ShroudedKeyBag     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509Certificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidAttributeLocalKeyID     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+)
+
+// loadSSLKeyPair loads the certificate in certFile and the private key in
+// keyFile.  If the key is encrypted, either in the traditional OpenSSL format
+// or as an encrypted PKCS#8 key, password is called to get the password to
+// decrypt it with.
+func loadSSLKeyPair(certFile, keyFile string, password func(file string) (string, error)) (tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block != nil && (block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block)) {
+		pw, err := password(keyFile)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if pw == "" {
+			return tls.Certificate{}, errors.New("pq: sslkey is encrypted, but no sslpassword was provided")
+		}
+		var der []byte
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			der, err = decryptPKCS8(block.Bytes, pw)
+			block = &pem.Block{Type: "PRIVATE KEY"}
+		} else {
+			der, err = x509.DecryptPEMBlock(block, []byte(pw))
+			if err == x509.IncorrectPasswordError {
+				err = errSSLKeyPassword
+			}
+			block = &pem.Block{Type: block.Type}
+		}
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("pq: could not decrypt %s: %v", keyFile, err)
+		}
+		block.Bytes = der
+		keyPEM = pem.EncodeToMemory(block)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// decryptPKCS8 decrypts an EncryptedPrivateKeyInfo structure, and returns the
+// DER encoded PKCS#8 private key.
+func decryptPKCS8(der []byte, password string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if err := unmarshalDER(der, &info); err != nil {
+		return nil, err
+	}
+	return decryptPBE(info.Algorithm, password, info.EncryptedData)
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// decryptPBE decrypts data, which is encrypted with a password based
+// encryption scheme described by alg.
+func decryptPBE(alg pkix.AlgorithmIdentifier, password string, data []byte) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+
+	switch {
+	case alg.Algorithm.Equal(oidPBES2):
+		var params pbes2Params
+		if err := unmarshalDER(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+			return nil, fmt.Errorf("unsupported key derivation function %v", params.KeyDerivationFunc.Algorithm)
+		}
+		var kdf pbkdf2Params
+		if err := unmarshalDER(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+			return nil, err
+		}
+		var prf func() hash.Hash
+		switch alg := kdf.PRF.Algorithm; {
+		case len(alg) == 0, alg.Equal(oidHMACWithSHA1):
+			prf = sha1.New
+		case alg.Equal(oidHMACWithSHA224):
+			prf = sha256.New224
+		case alg.Equal(oidHMACWithSHA256):
+			prf = sha256.New
+		case alg.Equal(oidHMACWithSHA384):
+			prf = sha512.New384
+		case alg.Equal(oidHMACWithSHA512):
+			prf = sha512.New
+		default:
+			return nil, fmt.Errorf("unsupported PBKDF2 pseudorandom function %v", alg)
+		}
+
+		var keyLen int
+		newCipher := aes.NewCipher
+		switch enc := params.EncryptionScheme.Algorithm; {
+		case enc.Equal(oidAES128CBC):
+			keyLen = 16
+		case enc.Equal(oidAES192CBC):
+			keyLen = 24
+		case enc.Equal(oidAES256CBC):
+			keyLen = 32
+		case enc.Equal(oidDESEDE3CBC):
+			keyLen = 24
+			newCipher = des.NewTripleDESCipher
+		default:
+			return nil, fmt.Errorf("unsupported encryption scheme %v", enc)
+		}
+		if kdf.KeyLength != 0 && kdf.KeyLength != keyLen {
+			return nil, fmt.Errorf("invalid key length %d", kdf.KeyLength)
+		}
+		if err := unmarshalDER(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+			return nil, err
+		}
+		var err error
+		block, err = newCipher(pbkdf2([]byte(password), kdf.Salt, kdf.IterationCount, keyLen, prf))
+		if err != nil {
+			return nil, err
+		}
+
+	case alg.Algorithm.Equal(oidPBEWithSHAAnd3KeyDESCBC):
+		var params pkcs12PBEParams
+		if err := unmarshalDER(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		pw := bmpString(password)
+		key := pkcs12KDF(sha1.New, 64, params.Salt, pw, params.Iterations, 1, 24)
+		iv = pkcs12KDF(sha1.New, 64, params.Salt, pw, params.Iterations, 2, 8)
+		var err error
+		block, err = des.NewTripleDESCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported encryption algorithm %v", alg.Algorithm)
+	}
+
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid encrypted data")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+
+	// A wrong password is only noticed here, as invalid padding.
+	n := int(out[len(out)-1])
+	if n == 0 || n > block.BlockSize() {
+		return nil, errSSLKeyPassword
+	}
+	for _, b := range out[len(out)-n:] {
+		if int(b) != n {
+			return nil, errSSLKeyPassword
+		}
+	}
+	return out[:len(out)-n], nil
+}
+
+// pbkdf2 implements the key derivation function of the same name from RFC
+// 8018.
+func pbkdf2(password, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+		for n := 1; n < iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// pkcs12KDF implements the key derivation function from RFC 7292, appendix
+// B.2.  v is the block size of the hash function in bytes, and id selects
+// whether a key (1), an IV (2) or a MAC key (3) is derived.
+func pkcs12KDF(h func() hash.Hash, v int, salt, password []byte, iter int, id byte, size int) []byte {
+	fill := func(b []byte) []byte {
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	var i []byte
+	if len(salt) > 0 {
+		i = append(i, fill(salt)...)
+	}
+	if len(password) > 0 {
+		i = append(i, fill(password)...)
+	}
+
+	var out []byte
+	for {
+		hh := h()
+		hh.Write(d)
+		hh.Write(i)
+		a := hh.Sum(nil)
+		for n := 1; n < iter; n++ {
+			hh.Reset()
+			hh.Write(a)
+			a = hh.Sum(a[:0])
+		}
+		out = append(out, a...)
+		if len(out) >= size {
+			return out[:size]
+		}
+
+		// I_j = (I_j + B + 1) mod 2^(8v) for every v byte block I_j of I
+		b := fill(a)[:v]
+		for j := 0; j < len(i); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				carry += int(i[j+k]) + int(b[k])
+				i[j+k] = byte(carry)
+				carry >>= 8
+			}
+		}
+	}
+}
+
+// bmpString returns s as a null terminated big endian UCS-2 string, which is
+// how PKCS#12 passes passwords to its key derivation function.
+func bmpString(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	out := make([]byte, 2*len(u)+2)
+	for i, c := range u {
+		binary.BigEndian.PutUint16(out[2*i:], c)
+	}
+	return out
+}
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// loadPKCS12 loads the certificate chain and the private key in the PKCS#12
+// file, using the password returned by password for both the integrity check
+// and the decryption of its contents.
+func loadPKCS12(file string, password func(file string) (string, error)) (tls.Certificate, error) {
+	der, err := ioutil.ReadFile(file)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	pw, err := password(file)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := parsePKCS12(der, pw)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("pq: could not load %s: %v", file, err)
+	}
+	return cert, nil
+}
+
+func parsePKCS12(der []byte, password string) (tls.Certificate, error) {
+	var pfx pfxPdu
+	if err := unmarshalDER(der, &pfx); err != nil {
+		return tls.Certificate{}, err
+	}
+	if pfx.Version != 3 {
+		return tls.Certificate{}, fmt.Errorf("unsupported PKCS#12 version %d", pfx.Version)
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidPKCS7Data) {
+		return tls.Certificate{}, errors.New("only password integrity mode is supported")
+	}
+	var authSafe []byte
+	if err := unmarshalDER(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return tls.Certificate{}, err
+	}
+	if len(pfx.MacData.Mac.Algorithm.Algorithm) > 0 {
+		if err := verifyPKCS12MAC(&pfx.MacData, authSafe, password); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	var contents []contentInfo
+	if err := unmarshalDER(authSafe, &contents); err != nil {
+		return tls.Certificate{}, err
+	}
+	var bags []safeBag
+	for _, ci := range contents {
+		var data []byte
+		switch {
+		case ci.ContentType.Equal(oidPKCS7Data):
+			if err := unmarshalDER(ci.Content.Bytes, &data); err != nil {
+				return tls.Certificate{}, err
+			}
+		case ci.ContentType.Equal(oidPKCS7EncryptedData):
+			var ed encryptedData
+			if err := unmarshalDER(ci.Content.Bytes, &ed); err != nil {
+				return tls.Certificate{}, err
+			}
+			var err error
+			data, err = decryptPBE(ed.EncryptedContentInfo.ContentEncryptionAlgorithm, password, ed.EncryptedContentInfo.EncryptedContent)
+			if err != nil {
+				return tls.Certificate{}, err
+			}
+		default:
+			return tls.Certificate{}, fmt.Errorf("unsupported PKCS#12 content type %v", ci.ContentType)
+		}
+		var b []safeBag
+		if err := unmarshalDER(data, &b); err != nil {
+			return tls.Certificate{}, err
+		}
+		bags = append(bags, b...)
+	}
+
+	// Find the private key, and the certificate with the same local key ID,
+	// which goes first in the chain.
+	var keyDER, keyID []byte
+	var certs, certIDs [][]byte
+	for _, bag := range bags {
+		switch {
+		case bag.ID.Equal(oidKeyBag), bag.ID.Equal(oidPKCS8ShroudedKeyBag):
+			if keyDER != nil {
+				return tls.Certificate{}, errors.New("more than one private key")
+			}
+			keyDER = bag.Value.Bytes
+			if bag.ID.Equal(oidPKCS8ShroudedKeyBag) {
+				var err error
+				keyDER, err = decryptPKCS8(bag.Value.Bytes, password)
+				if err != nil {
+					return tls.Certificate{}, err
+				}
+			}
+			keyID = bag.localKeyID()
+		case bag.ID.Equal(oidCertBag):
+			var cb certBag
+			if err := unmarshalDER(bag.Value.Bytes, &cb); err != nil {
+				return tls.Certificate{}, err
+			}
+			if cb.ID.Equal(oidCertTypeX509Certificate) {
+				certs = append(certs, cb.Data)
+				certIDs = append(certIDs, bag.localKeyID())
+			}
+		}
+	}
+	if keyDER == nil {
+		return tls.Certificate{}, errors.New("no private key found")
+	}
+	if len(certs) == 0 {
+		return tls.Certificate{}, errors.New("no certificate found")
+	}
+	for i, id := range certIDs {
+		if keyID != nil && bytes.Equal(id, keyID) {
+			certs[0], certs[i] = certs[i], certs[0]
+			break
+		}
+	}
+
+	var certPEM []byte
+	for _, c := range certs {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func (bag *safeBag) localKeyID() []byte {
+	for _, attr := range bag.Attributes {
+		if attr.ID.Equal(oidAttributeLocalKeyID) {
+			var id []byte
+			if unmarshalDER(attr.Value.Bytes, &id) == nil {
+				return id
+			}
+		}
+	}
+	return nil
+}
+
+func verifyPKCS12MAC(md *macData, content []byte, password string) error {
+	var h func() hash.Hash
+	v := 64
+	switch alg := md.Mac.Algorithm.Algorithm; {
+	case alg.Equal(oidSHA1):
+		h = sha1.New
+	case alg.Equal(oidSHA256):
+		h = sha256.New
+	case alg.Equal(oidSHA384):
+		h, v = sha512.New384, 128
+	case alg.Equal(oidSHA512):
+		h, v = sha512.New, 128
+	default:
+		return fmt.Errorf("unsupported PKCS#12 MAC algorithm %v", alg)
+	}
+	key := pkcs12KDF(h, v, md.MacSalt, bmpString(password), md.Iterations, 3, h().Size())
+	mac := hmac.New(h, key)
+	mac.Write(content)
+	if !hmac.Equal(mac.Sum(nil), md.Mac.Digest) {
+		return errSSLKeyPassword
+	}
+	return nil
+}
+
+// unmarshalDER is like asn1.Unmarshal, but fails if there is trailing data.
+func unmarshalDER(der []byte, v interface{}) error {
+	rest, err := asn1.Unmarshal(der, v)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return errors.New("trailing data after ASN.1 structure")
+	}
+	return nil
+}
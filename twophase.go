@@ -0,0 +1,72 @@
+//go:build go1.13
+// +build go1.13
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PrepareTransaction prepares the transaction running on c for two-phase
+// commit under the global transaction identifier gid.  The transaction must
+// have been begun with c.BeginTx.  Once prepared, the transaction is no longer
+// tied to c; it survives crashes of the server, and is committed or rolled
+// back with CommitPrepared or RollbackPrepared, from any connection to the
+// same database.
+//
+// The sql.Tx must still be ended with Commit or Rollback, to release c.
+// Neither affects the prepared transaction.
+//
+// If the transaction has failed, it is rolled back, and
+// ErrInFailedTransaction is returned.  If preparing the transaction fails,
+// the server rolls it back as well.
+func PrepareTransaction(ctx context.Context, c *sql.Conn, gid string) error {
+	return withConn(ctx, c, func(cn *conn) error {
+		return cn.prepareTransaction(gid)
+	})
+}
+
+// CommitPrepared commits the prepared transaction gid.  It must not be called
+// in a transaction.
+func CommitPrepared(ctx context.Context, db *sql.DB, gid string) error {
+	_, err := db.ExecContext(ctx, "COMMIT PREPARED "+quoteLiteral(gid))
+	return err
+}
+
+// RollbackPrepared rolls back the prepared transaction gid.  It must not be
+// called in a transaction.
+func RollbackPrepared(ctx context.Context, db *sql.DB, gid string) error {
+	_, err := db.ExecContext(ctx, "ROLLBACK PREPARED "+quoteLiteral(gid))
+	return err
+}
+
+// PreparedTransaction describes a transaction which has been prepared for
+// two-phase commit, but not yet committed or rolled back.
+type PreparedTransaction struct {
+	GID      string
+	Prepared time.Time
+	Owner    string
+	Database string
+}
+
+// PreparedTransactions returns the prepared transactions of the server,
+// oldest first.  After a failure of the transaction manager, these are the
+// transactions whose outcome is yet to be decided.
+func PreparedTransactions(ctx context.Context, db *sql.DB) ([]PreparedTransaction, error) {
+	rows, err := db.QueryContext(ctx, "SELECT gid, prepared, owner, database FROM pg_catalog.pg_prepared_xacts ORDER BY prepared")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var xacts []PreparedTransaction
+	for rows.Next() {
+		var x PreparedTransaction
+		if err := rows.Scan(&x.GID, &x.Prepared, &x.Owner, &x.Database); err != nil {
+			return nil, err
+		}
+		xacts = append(xacts, x)
+	}
+	return xacts, rows.Err()
+}
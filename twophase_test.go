@@ -0,0 +1,185 @@
+//go:build go1.13
+// +build go1.13
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestPrepareTransaction(t *testing.T) {
+	queries := make(chan string, 100)
+	connector, err := NewConnector(&Config{
+		User:    "u",
+		SSLMode: "disable",
+		Dialer:  fakeDialer{t: t, handler: txServer(queries)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	ctx := context.Background()
+	c, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, commit := range []bool{true, false} {
+		tx, err := c.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec("ok"); err != nil {
+			t.Fatal(err)
+		}
+		if err := PrepareTransaction(ctx, c, "it's x"); err != nil {
+			t.Fatal(err)
+		}
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A failed transaction is rolled back.
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Exec("fail")
+	if err := PrepareTransaction(ctx, c, "y"); err != ErrInFailedTransaction {
+		t.Fatalf("expected %v, got %v", ErrInFailedTransaction, err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// So is a transaction which can't be prepared, by the server.
+	tx, err = c.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("ok"); err != nil {
+		t.Fatal(err)
+	}
+	err = PrepareTransaction(ctx, c, "fail")
+	if err, ok := err.(*Error); !ok || err.Code.Name() != "object_not_in_prerequisite_state" {
+		t.Fatalf("expected object_not_in_prerequisite_state, got %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transaction begun and prepared without a sql.Tx must not affect the
+	// next one.
+	if _, err := c.ExecContext(ctx, "BEGIN"); err != nil {
+		t.Fatal(err)
+	}
+	if err := PrepareTransaction(ctx, c, "z"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err = c.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("ok"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CommitPrepared(ctx, db, "it's x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RollbackPrepared(ctx, db, `back\slash`); err != nil {
+		t.Fatal(err)
+	}
+	// The connection must be in a normal state again.
+	if _, err := c.ExecContext(ctx, "ok"); err != nil {
+		t.Fatal(err)
+	}
+
+	close(queries)
+	var got []string
+	for q := range queries {
+		got = append(got, q)
+	}
+	want := []string{
+		`BEGIN`, `ok`, `PREPARE TRANSACTION 'it''s x'`,
+		`BEGIN`, `ok`, `PREPARE TRANSACTION 'it''s x'`,
+		`BEGIN`, `fail`, `ROLLBACK`,
+		`BEGIN`, `ok`, `PREPARE TRANSACTION 'fail'`,
+		`BEGIN`, `PREPARE TRANSACTION 'z'`, `BEGIN`, `ok`, `COMMIT`,
+		`COMMIT PREPARED 'it''s x'`,
+		`ROLLBACK PREPARED E'back\\slash'`,
+		`ok`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got statements\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestTwoPhaseCommit(t *testing.T) {
+	db := openTestConn(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	c, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("CREATE TEMP TABLE IF NOT EXISTS pqgotest_2pc (a int)"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	tx, err = c.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+	err = PrepareTransaction(ctx, c, "pqgotest")
+	if err, ok := err.(*Error); ok && err.Code.Name() == "object_not_in_prerequisite_state" {
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		t.Skip("prepared transactions are disabled")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	xacts, err := PreparedTransactions(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, x := range xacts {
+		found = found || x.GID == "pqgotest"
+	}
+	if !found {
+		t.Fatalf("prepared transaction not found in %v", xacts)
+	}
+	if err := RollbackPrepared(ctx, db, "pqgotest"); err != nil {
+		t.Fatal(err)
+	}
+}
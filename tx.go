@@ -0,0 +1,107 @@
+//go:build go1.13
+// +build go1.13
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The limits of RunInTx.  They can be changed in tests.
+var (
+	txMaxAttempts = 10
+	txMinBackoff  = 10 * time.Millisecond
+	txMaxBackoff  = time.Second
+)
+
+var txRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// RunInTx runs fn in a transaction begun on db with opts, and commits the
+// transaction if fn returns nil.  If fn returns an error, the transaction is
+// rolled back and the error is returned.
+//
+// If the transaction fails with a serialization_failure (SQLSTATE 40001) or
+// deadlock_detected (40P01) error, either in fn or when committing, the
+// server has rolled it back, and RunInTx runs fn again in a new transaction.
+// This is what the Postgres documentation recommends for SERIALIZABLE and
+// REPEATABLE READ transactions.  There are at most 10 attempts, and the
+// delay between them increases from 10ms to at most 1s.  If ctx is done,
+// RunInTx gives up early.  The error of the last attempt is returned.
+//
+// fn may thus be called several times, and must not have side effects
+// outside the transaction.  It may return pq errors wrapped in other errors.
+//
+// RunInTx never retries after other errors from COMMIT, since the
+// transaction may then have been committed.
+func RunInTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(*sql.Tx) error) error {
+	backoff := txMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := runTx(ctx, db, opts, fn)
+		if err == nil || attempt == txMaxAttempts || !isRetryableTxError(err) {
+			return err
+		}
+
+		// Wait for half to all of the backoff, so that competing
+		// transactions which failed together don't retry together.
+		delay := backoff
+		if half := backoff / 2; half > 0 {
+			txRand.Lock()
+			delay = half + time.Duration(txRand.Int63n(int64(half)))
+			txRand.Unlock()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > txMaxBackoff {
+			backoff = txMaxBackoff
+		}
+	}
+}
+
+// runTx makes a single attempt of RunInTx.
+func runTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// isRetryableTxError reports whether err means that the server rolled back
+// the transaction because of a conflict with concurrent transactions, so
+// that running it again may succeed.
+func isRetryableTxError(err error) bool {
+	var pqErr *Error
+	if !errors.As(err, &pqErr) || pqErr.Code.Class() != "40" {
+		return false
+	}
+	// Of the other errors in class 40 (transaction rollback),
+	// statement_completion_unknown in particular leaves the outcome unknown.
+	switch pqErr.Code.Name() {
+	case "serialization_failure", "deadlock_detected":
+		return true
+	}
+	return false
+}
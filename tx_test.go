@@ -0,0 +1,124 @@
+//go:build go1.13
+// +build go1.13
+
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRunInTx(t *testing.T) {
+	queries := make(chan string, 1000)
+	connector, err := NewConnector(&Config{
+		User:    "u",
+		SSLMode: "disable",
+		Dialer:  fakeDialer{t: t, handler: txServer(queries)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	ctx := context.Background()
+
+	// fails returns a function for RunInTx which fails with the given error
+	// codes on the first attempts.
+	fails := func(attempts *int, codes ...string) func(*sql.Tx) error {
+		return func(tx *sql.Tx) error {
+			*attempts++
+			q := "ok"
+			if *attempts <= len(codes) {
+				q = "fail " + codes[*attempts-1]
+			}
+			if _, err := tx.Exec(q); err != nil {
+				return fmt.Errorf("wrapped: %w", err)
+			}
+			return nil
+		}
+	}
+
+	var attempts int
+	if err := RunInTx(ctx, db, nil, fails(&attempts, "40001", "40P01", "40001")); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 4 {
+		t.Errorf("expected 4 attempts, got %d", attempts)
+	}
+
+	// So are serialization failures detected when committing.
+	attempts = 0
+	err = RunInTx(ctx, db, nil, func(tx *sql.Tx) error {
+		attempts++
+		q := "ok"
+		if attempts == 1 {
+			q = "fail at commit 40001"
+		}
+		_, err := tx.Exec(q)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+
+	// Other errors are returned right away.
+	for _, code := range []string{"23505", "40003"} {
+		attempts = 0
+		err = RunInTx(ctx, db, nil, fails(&attempts, code))
+		var pqErr *Error
+		if !errors.As(err, &pqErr) || string(pqErr.Code) != code {
+			t.Errorf("expected error %s, got %v", code, err)
+		}
+		if attempts != 1 {
+			t.Errorf("%s: expected 1 attempt, got %d", code, attempts)
+		}
+	}
+
+	// The backoff may be too short to be randomized.
+	minBackoff := txMinBackoff
+	txMinBackoff = time.Nanosecond
+	attempts = 0
+	err = RunInTx(ctx, db, nil, fails(&attempts, "40001"))
+	txMinBackoff = minBackoff
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+
+	// The number of attempts is limited.
+	defer func(d time.Duration) { txMaxBackoff = d }(txMaxBackoff)
+	txMaxBackoff = 2 * txMinBackoff
+	attempts = 0
+	codes := make([]string, 20)
+	for i := range codes {
+		codes[i] = "40001"
+	}
+	err = RunInTx(ctx, db, nil, fails(&attempts, codes...))
+	if !isRetryableTxError(err) {
+		t.Errorf("expected a serialization failure, got %v", err)
+	}
+	if attempts != txMaxAttempts {
+		t.Errorf("expected %d attempts, got %d", txMaxAttempts, attempts)
+	}
+
+	// So is the time, by ctx.
+	attempts = 0
+	cctx, cancel := context.WithCancel(ctx)
+	err = RunInTx(cctx, db, nil, func(tx *sql.Tx) error {
+		err := fails(&attempts, codes...)(tx)
+		cancel()
+		return err
+	})
+	if !isRetryableTxError(err) || attempts != 1 {
+		t.Errorf("expected a serialization failure after 1 attempt, got %v after %d", err, attempts)
+	}
+}
@@ -28,8 +28,32 @@ import (
 //
 //	"postgres://"
 //
-// This will be blank, causing driver.Open to use all of the defaults
+// This will be blank, causing driver.Open to use all of the defaults.
+//
+// Multiple hosts, each with an optional port, may be given separated by commas:
+//
+//	"postgres://host1:5432,host2:5433/mydb"
+//
+// converts to:
+//
+//	"dbname=mydb host=host1,host2 port=5432,5433"
 func ParseURL(url string) (string, error) {
+	// net/url does not understand a list of hosts, so take it out of the URL
+	// before parsing the rest.
+	var hostList []string
+	if i := strings.Index(url, "://"); i >= 0 {
+		rest := url[i+3:]
+		end := strings.IndexAny(rest, "/?#")
+		if end < 0 {
+			end = len(rest)
+		}
+		at := strings.LastIndex(rest[:end], "@")
+		if hosts := rest[at+1 : end]; strings.Contains(hosts, ",") {
+			hostList = strings.Split(hosts, ",")
+			url = url[:i+3] + rest[:at+1] + rest[end:]
+		}
+	}
+
 	u, err := nurl.Parse(url)
 	if err != nil {
 		return "", err
@@ -55,11 +79,34 @@ func ParseURL(url string) (string, error) {
 		accrue("password", v)
 	}
 
-	if host, port, err := net.SplitHostPort(u.Host); err != nil {
-		accrue("host", u.Host)
-	} else {
-		accrue("host", host)
-		accrue("port", port)
+	// Unlike u.Host, the entries of a list of hosts are still escaped.
+	unescape := hostList != nil
+	if hostList == nil {
+		hostList = []string{u.Host}
+	}
+	var hosts, ports []string
+	var hasPort bool
+	for _, h := range hostList {
+		host, port, err := net.SplitHostPort(h)
+		if err != nil {
+			host, port = h, ""
+			// An IPv6 address without a port.
+			if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+				host = host[1 : len(host)-1]
+			}
+		}
+		if unescape {
+			if host, err = nurl.PathUnescape(host); err != nil {
+				return "", err
+			}
+		}
+		hosts = append(hosts, host)
+		ports = append(ports, port)
+		hasPort = hasPort || port != ""
+	}
+	accrue("host", strings.Join(hosts, ","))
+	if hasPort {
+		accrue("port", strings.Join(ports, ","))
 	}
 
 	if u.Path != "" {
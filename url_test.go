@@ -64,3 +64,26 @@ func TestMinimalURL(t *testing.T) {
 		t.Fatalf("expected blank connection string, got: %q", cs)
 	}
 }
+
+func TestMultiHostParseURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"postgres://a:1,b:2/db", "dbname=db host=a,b port=1,2"},
+		{"postgres://user:pw@a,b/db?target_session_attrs=read-write", "dbname=db host=a,b password=pw target_session_attrs=read-write user=user"},
+		{"postgres://a,b:5433,[::1]:5434", "host=a,b,::1 port=,5433,5434"},
+		{"postgres://[::1],[::2]:5433/db", "dbname=db host=::1,::2 port=,5433"},
+		{"postgres://my%2Dhost,%2Ftmp/db", "dbname=db host=my-host,/tmp"},
+	}
+	for _, tt := range tests {
+		str, err := ParseURL(tt.url)
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if str != tt.expected {
+			t.Errorf("unexpected result from ParseURL(%q):\n+ %v\n- %v", tt.url, str, tt.expected)
+		}
+	}
+}